@@ -0,0 +1,157 @@
+// Sends the photos picked on the gallery edit page a chunk at a time using
+// the resumable upload api, see controllers/uploads.go. A chunk that fails
+// is retried, and an upload cut off by closing the page picks up where it
+// left off if the same file is picked again. Browsers without what this
+// needs just submit the form like normal.
+(function() {
+  var form = document.querySelector("form.chunked-upload");
+  if (!form || !window.fetch || !window.crypto || !window.crypto.subtle) {
+    return;
+  }
+  var progress = form.querySelector(".upload-progress");
+  var baseURL = form.dataset.uploadsUrl;
+  var maxAttempts = 5;
+
+  form.addEventListener("submit", function(e) {
+    var files = [];
+    form.querySelectorAll("input[type=file]").forEach(function(input) {
+      Array.prototype.push.apply(files, input.files);
+    });
+    if (files.length === 0) {
+      return;
+    }
+    e.preventDefault();
+    form.querySelector("button[type=submit]").disabled = true;
+
+    var failed = [];
+    var done = 0;
+    var next = Promise.resolve();
+    files.forEach(function(file) {
+      next = next.then(function() {
+        show("Uploading " + file.name + " (" + (done + 1) + " of " + files.length + ")");
+        return upload(file).catch(function(err) {
+          failed.push(file.name + ": " + err.message);
+        }).then(function() {
+          done++;
+        });
+      });
+    });
+    next.then(function() {
+      if (failed.length === 0) {
+        window.location.reload();
+        return;
+      }
+      show((files.length - failed.length) + " of " + files.length +
+        " photos uploaded. These couldn't be added:\n" + failed.join("\n"));
+      form.querySelector("button[type=submit]").disabled = false;
+    });
+  });
+
+  function show(msg) {
+    progress.textContent = msg;
+  }
+
+  function upload(file) {
+    var key = "upload:" + baseURL + ":" + file.name + ":" + file.size + ":" + file.lastModified;
+    return resume(key).then(function(status) {
+      return status || request("POST", baseURL, {
+        headers: {"Content-Type": "application/json"},
+        body: JSON.stringify({filename: file.name, size: file.size})
+      });
+    }).then(function(status) {
+      localStorage.setItem(key, status.id);
+      return sendChunks(file, status);
+    }).then(function(status) {
+      return request("POST", baseURL + "/" + status.id + "/finish", {});
+    }).then(function(result) {
+      localStorage.removeItem(key);
+      return result;
+    }, function(err) {
+      if (err.status === 422) {
+        // the photo itself was rejected, trying again won't help
+        localStorage.removeItem(key);
+      }
+      throw err;
+    });
+  }
+
+  // resume looks up an upload of the same file that didn't finish, if the
+  // server still has it.
+  function resume(key) {
+    var id = localStorage.getItem(key);
+    if (!id) {
+      return Promise.resolve(null);
+    }
+    return request("GET", baseURL + "/" + id, {}).catch(function() {
+      localStorage.removeItem(key);
+      return null;
+    });
+  }
+
+  function sendChunks(file, status) {
+    if (status.offset >= status.size) {
+      return Promise.resolve(status);
+    }
+    var chunk = file.slice(status.offset, status.offset + status.chunk_size);
+    return chunk.arrayBuffer().then(function(buf) {
+      return crypto.subtle.digest("SHA-256", buf).then(function(sum) {
+        return sendChunk(status, buf, hex(sum), 1);
+      });
+    }).then(function(status) {
+      return sendChunks(file, status);
+    });
+  }
+
+  function sendChunk(status, buf, sum, attempt) {
+    var url = baseURL + "/" + status.id + "?offset=" + status.offset;
+    return request("PUT", url, {
+      headers: {"X-Chunk-SHA256": sum},
+      body: buf
+    }).catch(function(err) {
+      if (err.status === 409) {
+        // the server is somewhere else, most likely it got a chunk we
+        // never heard back about, so carry on from wherever it is
+        return Object.assign({}, status, {offset: err.body.offset});
+      }
+      if ((err.status && err.status < 500 && err.status !== 422) || attempt >= maxAttempts) {
+        throw err;
+      }
+      // flaky connection, back off and send it again
+      return wait(1000 * Math.pow(2, attempt)).then(function() {
+        return sendChunk(status, buf, sum, attempt + 1);
+      });
+    });
+  }
+
+  function request(method, url, opts) {
+    var token = document.querySelector("input[name='gorilla.csrf.Token']");
+    opts.method = method;
+    opts.credentials = "same-origin";
+    opts.headers = Object.assign({"X-CSRF-Token": token ? token.value : ""}, opts.headers);
+    return fetch(url, opts).then(function(resp) {
+      return resp.json().catch(function() {
+        return {};
+      }).then(function(body) {
+        if (resp.ok) {
+          return body;
+        }
+        var err = new Error(body.error || "Something went wrong, please try again.");
+        err.status = resp.status;
+        err.body = body;
+        throw err;
+      });
+    });
+  }
+
+  function wait(ms) {
+    return new Promise(function(resolve) {
+      setTimeout(resolve, ms);
+    });
+  }
+
+  function hex(buf) {
+    return Array.prototype.map.call(new Uint8Array(buf), function(b) {
+      return ("0" + b.toString(16)).slice(-2);
+    }).join("");
+  }
+})();
@@ -0,0 +1,66 @@
+// Drag and drop reordering for the images on the gallery edit page. The new
+// order is posted as JSON as soon as an image is dropped.
+(function() {
+  var list = document.querySelector(".gallery-order");
+  if (!list) {
+    return;
+  }
+  var dragging = null;
+
+  list.addEventListener("dragstart", function(e) {
+    dragging = e.target.closest(".gallery-order-item");
+    if (!dragging) {
+      return;
+    }
+    dragging.classList.add("dragging");
+    e.dataTransfer.effectAllowed = "move";
+  });
+
+  list.addEventListener("dragover", function(e) {
+    if (!dragging) {
+      return;
+    }
+    e.preventDefault();
+    var over = e.target.closest(".gallery-order-item");
+    if (!over || over === dragging) {
+      return;
+    }
+    var rect = over.getBoundingClientRect();
+    var after = e.clientY > rect.top + rect.height / 2;
+    list.insertBefore(dragging, after ? over.nextSibling : over);
+  });
+
+  list.addEventListener("drop", function(e) {
+    e.preventDefault();
+  });
+
+  list.addEventListener("dragend", function() {
+    if (!dragging) {
+      return;
+    }
+    dragging.classList.remove("dragging");
+    dragging = null;
+    save();
+  });
+
+  function save() {
+    var order = [];
+    list.querySelectorAll(".gallery-order-item").forEach(function(item) {
+      order.push(item.dataset.name);
+    });
+    var token = document.querySelector("input[name='gorilla.csrf.Token']");
+    fetch(list.dataset.orderUrl, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: {
+        "Content-Type": "application/json",
+        "X-CSRF-Token": token ? token.value : ""
+      },
+      body: JSON.stringify({order: order})
+    }).then(function(resp) {
+      if (!resp.ok) {
+        alert("Sorry, the new order couldn't be saved. Reload the page and try again.");
+      }
+    });
+  }
+})();
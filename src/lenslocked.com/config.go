@@ -3,7 +3,13 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
+	"strings"
+	"time"
 
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
 	"github.com/kelseyhightower/envconfig"
 )
 
@@ -23,13 +29,62 @@ type MailgunConfig struct {
 	ElisEmailAddress string `envconfig:"ELIS_EMAIL_ADDRESS"`
 }
 
+// StorageConfig picks where uploaded images are kept. Backend is either
+// "local" (the default) or "s3", which also works with anything that speaks
+// the S3 api like MinIO.
+type StorageConfig struct {
+	Backend     string `envconfig:"STORAGE_BACKEND"`
+	LocalDir    string `envconfig:"STORAGE_LOCAL_DIR"`
+	S3Endpoint  string `envconfig:"S3_ENDPOINT"`
+	S3Region    string `envconfig:"S3_REGION"`
+	S3Bucket    string `envconfig:"S3_BUCKET"`
+	S3AccessKey string `envconfig:"S3_ACCESS_KEY"`
+	S3SecretKey string `envconfig:"S3_SECRET_KEY"`
+}
+
+// QuotaConfig is how much each user can store. Zero means no limit.
+type QuotaConfig struct {
+	MaxBytes  int64 `envconfig:"QUOTA_MAX_BYTES" default:"5368709120"`
+	MaxImages int   `envconfig:"QUOTA_MAX_IMAGES" default:"10000"`
+}
+
+// UnverifiedConfig is what people can't do until they've verified their
+// email address.
+type UnverifiedConfig struct {
+	BlockUploads   bool `envconfig:"UNVERIFIED_BLOCK_UPLOADS" default:"true"`
+	BlockGalleries bool `envconfig:"UNVERIFIED_BLOCK_GALLERIES" default:"false"`
+	BlockSharing   bool `envconfig:"UNVERIFIED_BLOCK_SHARING" default:"false"`
+}
+
 type Config struct {
-	Port     int
-	Env      string
-	Pepper   string
-	HMACKey  string `split_words:"true"`
-	Database PostgresConfig
-	Mailgun  MailgunConfig
+	Port    int
+	Env     string
+	Pepper  string
+	HMACKey string `split_words:"true"`
+	// TOTPKey encrypts two factor secrets. Without it they're encrypted with
+	// a key made from HMACKey. Don't change it once people have turned two
+	// factor on, their apps' codes stop working and they need a recovery code.
+	TOTPKey string `split_words:"true"`
+	// ImageURLKeys signs image URLs, written as "id:secret,id:secret". New
+	// URLs are signed with the first key and any of them are accepted, so to
+	// rotate add a new key at the front and drop the old one a day or two
+	// later once the URLs it signed have expired.
+	ImageURLKeys string `split_words:"true"`
+	Database     PostgresConfig
+	Mailgun      MailgunConfig
+	Storage      StorageConfig
+	Quota        QuotaConfig
+	Unverified   UnverifiedConfig
+
+	// TrashRetentionDays is how long deleted galleries and photos sit in the
+	// trash before they're purged for good. 0 keeps them until they're
+	// purged by hand.
+	TrashRetentionDays int `split_words:"true" default:"30"`
+
+	// TrustedProxies are the proxies allowed to set X-Forwarded-For, written
+	// as "10.0.0.0/8,192.168.1.5". Leave it empty unless the app is only
+	// reachable through them, otherwise anyone can pick their own IP.
+	TrustedProxies string `split_words:"true"`
 }
 
 func NewConfig(configRequired bool) Config {
@@ -48,6 +103,11 @@ func DefaultConfig() Config {
 		Pepper:   "secret-random-string",
 		HMACKey:  "secret-hmac-key",
 		Database: DefaultPostgresConfig(),
+		Storage:  DefaultStorageConfig(),
+		Quota:    DefaultQuotaConfig(),
+
+		Unverified:         DefaultUnverifiedConfig(),
+		TrashRetentionDays: 30,
 	}
 }
 
@@ -55,6 +115,72 @@ func (c Config) IsProd() bool {
 	return c.Env == "prod"
 }
 
+// TrashRetention is how long things stay in the trash, 0 for forever.
+func (c Config) TrashRetention() time.Duration {
+	if c.TrashRetentionDays <= 0 {
+		return 0
+	}
+	return time.Duration(c.TrashRetentionDays) * 24 * time.Hour
+}
+
+// TwoFactorKey is what two factor secrets are encrypted with.
+func (c Config) TwoFactorKey() string {
+	if c.TOTPKey != "" {
+		return c.TOTPKey
+	}
+	return "totp:" + c.HMACKey
+}
+
+// EmailJobKey is what tokens in queued emails are encrypted with. Changing
+// HMACKey already breaks every outstanding link, so there's nothing gained
+// from a separate setting.
+func (c Config) EmailJobKey() string {
+	return "email-jobs:" + c.HMACKey
+}
+
+// Proxies parses TrustedProxies, a bare address is a network of one.
+func (c Config) Proxies() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(c.TrustedProxies, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// URLSigner is what image URLs get signed with. Without ImageURLKeys set it
+// falls back to a key made from HMACKey, which is fine until it's time to
+// rotate.
+func (c Config) URLSigner() (*hash.URLSigner, error) {
+	keys, err := hash.ParseSignerKeys(c.ImageURLKeys)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		keys = []hash.SignerKey{{ID: "0", Secret: "image-urls:" + c.HMACKey}}
+	}
+	return hash.NewURLSigner(keys...)
+}
+
 func DefaultPostgresConfig() PostgresConfig {
 	return PostgresConfig{
 		Host:     "localhost",
@@ -82,3 +208,62 @@ func (c PostgresConfig) ConnectionInfo() string {
 	}
 	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s", c.Host, c.Port, c.User, c.Password, c.Name, sslMode)
 }
+
+func DefaultQuotaConfig() QuotaConfig {
+	return QuotaConfig{
+		MaxBytes:  5 << 30, // 5 gb
+		MaxImages: 10000,
+	}
+}
+
+func (c QuotaConfig) Quota() models.Quota {
+	return models.Quota{
+		MaxBytes:  c.MaxBytes,
+		MaxImages: c.MaxImages,
+	}
+}
+
+func DefaultUnverifiedConfig() UnverifiedConfig {
+	return UnverifiedConfig{BlockUploads: true}
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Backend:  "local",
+		LocalDir: "images",
+	}
+}
+
+// IsLocal is true when images are kept on this server's disk, which means
+// we are the ones that have to serve them.
+func (c StorageConfig) IsLocal() bool {
+	return c.Backend == "" || c.Backend == "local"
+}
+
+func (c StorageConfig) Dir() string {
+	if c.LocalDir == "" {
+		return "images"
+	}
+	return c.LocalDir
+}
+
+// Store builds the storage backend described by the config.
+func (c StorageConfig) Store() (storage.Store, error) {
+	switch {
+	case c.IsLocal():
+		return storage.NewLocal(c.Dir()), nil
+	case c.Backend == "s3":
+		if c.S3Endpoint == "" || c.S3Bucket == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required for the s3 storage backend")
+		}
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  c.S3Endpoint,
+			Region:    c.S3Region,
+			Bucket:    c.S3Bucket,
+			AccessKey: c.S3AccessKey,
+			SecretKey: c.S3SecretKey,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", c.Backend)
+	}
+}
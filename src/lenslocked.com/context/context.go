@@ -12,7 +12,9 @@ const (
 	// Our privateKey type, while backed by a string, is not actu­ally
 	// the same as a string, and the keys used for the context package
 	// take both the type and the value into consideration.
-	userKey privateKey = "user"
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
+	ipKey      privateKey = "ip"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -27,3 +29,31 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithSession keeps the session the user was found through, so eg logging
+// out knows which one to end.
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+// WithIP keeps the client's address as worked out by the user middleware,
+// which knows which proxies to believe.
+func WithIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, ipKey, ip)
+}
+
+func IP(ctx context.Context) string {
+	if ip, ok := ctx.Value(ipKey).(string); ok {
+		return ip
+	}
+	return ""
+}
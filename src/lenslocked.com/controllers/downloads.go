@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+// manifestName is the file in every download listing what's in it.
+const manifestName = "manifest.csv"
+
+// GET /galleries/show/:id/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.CanView(context.User(r.Context())) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	if !g.requireUnlocked(w, r, gallery) {
+		return
+	}
+	g.writeZip(w, r, gallery)
+}
+
+// GET /g/:token/download
+func (g *Galleries) DownloadUnlisted(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.GalleryService.ByShareToken(mux.Vars(r)["token"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !g.requireUnlocked(w, r, gallery) {
+		return
+	}
+	if err := g.loadImages(w, gallery); err != nil {
+		return
+	}
+	g.writeZip(w, r, gallery)
+}
+
+// GET /s/:token/download
+//
+// Downloading counts as a view, otherwise a link that had used up its views
+// could still be used to download everything as many times as anyone liked.
+func (g *Galleries) DownloadShared(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	link, err := g.ShareLinkService.ByToken(token)
+	if err == nil && link.Expired() {
+		err = models.ErrShareLinkExpired
+	}
+	if err == nil && link.UsedUp() {
+		err = models.ErrShareLinkUsedUp
+	}
+	var gallery *models.Gallery
+	if err == nil {
+		gallery, err = g.GalleryService.ByID(link.GalleryID)
+	}
+	if err == nil && !galleryUnlocked(g.GalleryService, r, gallery) {
+		// same as ShareShow, the password page doesn't use up a view
+		g.requireUnlocked(w, r, gallery)
+		return
+	}
+	if err == nil {
+		_, err = g.ShareLinkService.Redeem(token)
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "This share link doesn't exist or has been revoked", http.StatusNotFound)
+		case models.ErrShareLinkExpired, models.ErrShareLinkUsedUp:
+			http.Error(w, err.(views.PublicError).Public(), http.StatusGone)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := g.loadImages(w, gallery); err != nil {
+		return
+	}
+	g.writeZip(w, r, gallery)
+}
+
+// writeZip streams the gallery's images to the client as a zip, one file
+// at a time straight from storage so nothing bigger than a copy buffer is
+// held in memory. The variant query param picks a resized copy instead of
+// the originals, images that don't have it yet fall back to the original.
+func (g *Galleries) writeZip(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	variant := r.FormValue("variant")
+	if variant != "" && !validVariant(variant) {
+		http.Error(w, "Unknown image size", http.StatusBadRequest)
+		return
+	}
+	owner := gallery.OwnedBy(context.User(r.Context()))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": zipName(gallery, variant),
+	}))
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	zw := zip.NewWriter(w)
+	used := map[string]bool{manifestName: true}
+	manifest := [][]string{{"file", "original_filename", "caption", "alt_text", "taken_at"}}
+	for i := range gallery.Images {
+		image := &gallery.Images[i]
+		key, name := originalKey(image, gallery, owner), image.Filename
+		if variant != "" && image.HasVariant(variant) {
+			key = image.VariantKey(variant)
+			name = strings.TrimSuffix(name, path.Ext(name)) + ".jpg"
+		}
+		if key == "" {
+			// still has its metadata, it'll be in the zip once the
+			// variants job has stripped it
+			continue
+		}
+		name = uniqueName(used, name)
+
+		err := g.addToZip(zw, key, name)
+		if err == storage.ErrNotExist {
+			fmt.Printf("Leaving %s out of gallery %d's zip, it's missing from storage\n", key, gallery.ID)
+			continue
+		}
+		if err != nil {
+			// the headers are long gone so all we can do is stop, which
+			// leaves the client with an archive it can tell is truncated
+			fmt.Printf("Failed writing gallery %d's zip: %s\n", gallery.ID, err)
+			return
+		}
+
+		var takenAt string
+		if image.TakenAt != nil {
+			takenAt = image.TakenAt.Format("2006-01-02 15:04:05")
+		}
+		manifest = append(manifest, []string{name, image.Filename, image.Caption, image.AltText, takenAt})
+	}
+
+	mf, err := zw.Create(manifestName)
+	if err == nil {
+		cw := csv.NewWriter(mf)
+		cw.WriteAll(manifest)
+		err = cw.Error()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		fmt.Printf("Failed writing gallery %d's zip: %s\n", gallery.ID, err)
+	}
+}
+
+// addToZip copies the file at key into the archive as name.
+func (g *Galleries) addToZip(zw *zip.Writer, key, name string) error {
+	f, obj, err := g.ImageService.Open(key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zf, err := zw.CreateHeader(&zip.FileHeader{
+		Name: name,
+		// images are already compressed, squeezing them again just burns cpu
+		Method:   zip.Store,
+		Modified: obj.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(zf, f)
+	return err
+}
+
+func validVariant(name string) bool {
+	for _, v := range models.ImageVariantNames() {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueName returns name, or name with a number added if it's already been
+// used, since nothing stops two uploads having the same filename.
+func uniqueName(used map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; used[name]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	used[name] = true
+	return name
+}
+
+// zipName is what the browser saves the download as, the gallery title
+// with anything awkward in a filename taken out.
+func zipName(gallery *models.Gallery, variant string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, gallery.Title)
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	if variant != "" {
+		name += " (" + variant + ")"
+	}
+	return name + ".zip"
+}
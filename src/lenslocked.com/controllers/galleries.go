@@ -2,8 +2,12 @@ package controllers
 
 import (
 	"fmt"
+	"mime/multipart"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/eitah/lenslocked/src/lenslocked.com/context"
 	"github.com/eitah/lenslocked/src/lenslocked.com/models"
@@ -12,35 +16,55 @@ import (
 )
 
 const (
-	ShowGallery    = "show_gallery"
-	IndexGalleries = "index_gallery"
-	EditGallery    = "edit_gallery"
+	ShowGallery     = "show_gallery"
+	UnlistedGallery = "unlisted_gallery"
+	IndexGalleries  = "index_gallery"
+	EditGallery     = "edit_gallery"
 )
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+// NewGalleries sets up the gallery pages. trashRetention is how long deleted
+// galleries and images are kept in the trash, 0 for forever.
+func NewGalleries(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, us models.UploadSessionService, usage models.UsageService, trashRetention time.Duration, r *mux.Router) *Galleries {
 	return &Galleries{
-		NewView:        views.NewView("bootstrap", "galleries/new"),
-		ShowView:       views.NewView("bootstrap", "galleries/show"),
-		EditView:       views.NewView("bootstrap", "galleries/edit"),
-		IndexView:      views.NewView("bootstrap", "galleries/index"),
-		GalleryService: gs,
-		ImageService:   is,
-		r:              r,
+		NewView:          views.NewView("bootstrap", "galleries/new"),
+		ShowView:         views.NewView("bootstrap", "galleries/show"),
+		EditView:         views.NewView("bootstrap", "galleries/edit"),
+		IndexView:        views.NewView("bootstrap", "galleries/index"),
+		UnlockView:       views.NewView("bootstrap", "galleries/unlock"),
+		TrashView:        views.NewView("bootstrap", "galleries/trash"),
+		GalleryService:   gs,
+		ImageService:     is,
+		ShareLinkService: sls,
+		UploadService:    us,
+		UsageService:     usage,
+		TrashRetention:   trashRetention,
+		r:                r,
 	}
 }
 
 type Galleries struct {
-	NewView        *views.View
-	ShowView       *views.View
-	EditView       *views.View
-	IndexView      *views.View
-	GalleryService models.GalleryService
-	ImageService   models.ImageService
-	r              *mux.Router
+	NewView          *views.View
+	ShowView         *views.View
+	EditView         *views.View
+	IndexView        *views.View
+	UnlockView       *views.View
+	TrashView        *views.View
+	GalleryService   models.GalleryService
+	ImageService     models.ImageService
+	ShareLinkService models.ShareLinkService
+	UploadService    models.UploadSessionService
+	UsageService     models.UsageService
+	TrashRetention   time.Duration
+	r                *mux.Router
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title          string `schema:"title"`
+	Visibility     string `schema:"visibility"`
+	MetadataPolicy string `schema:"metadata"`
+	// Password is left blank to keep the current one.
+	Password       string `schema:"password"`
+	RemovePassword bool   `schema:"remove_password"`
 }
 
 // GET /galleries/new
@@ -56,11 +80,61 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !gallery.CanView(context.User(r.Context())) {
+		// same as a missing gallery so ids can't be used to find private ones
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	if !g.requireUnlocked(w, r, gallery) {
+		return
+	}
+	gallery.DownloadPath = path.Join(r.URL.Path, "download")
+
 	var vd views.Data
 	vd.Yield = gallery
 	g.ShowView.Render(w, r, vd)
 }
 
+// GET /g/:token
+func (g *Galleries) ShowUnlisted(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.GalleryService.ByShareToken(mux.Vars(r)["token"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.",
+				http.StatusInternalServerError)
+		}
+		return
+	}
+	if !g.requireUnlocked(w, r, gallery) {
+		return
+	}
+	if err := g.loadImages(w, gallery); err != nil {
+		return
+	}
+	// the images on the page are checked against this, like share links
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlistedCookieName(gallery.ID),
+		Value:    gallery.ShareToken,
+		Path:     fmt.Sprintf("/images/galleries/%d/", gallery.ID),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	gallery.DownloadPath = path.Join(r.URL.Path, "download")
+
+	var vd views.Data
+	vd.Yield = gallery
+	g.ShowView.Render(w, r, vd)
+}
+
+// unlistedCookieName is the cookie holding the token of the unlisted link
+// a visitor opened the gallery with.
+func unlistedCookieName(galleryID uint) string {
+	return fmt.Sprintf("unlisted_%d", galleryID)
+}
+
 // post /galleries/new
 func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
@@ -75,8 +149,11 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	// This is what the validator code is for, keeping this from being brittle.
 	user := context.User(r.Context())
 	gallery := models.Gallery{
-		UserID: user.ID,
-		Title:  form.Title,
+		UserID:         user.ID,
+		Title:          form.Title,
+		Visibility:     form.Visibility,
+		MetadataPolicy: form.MetadataPolicy,
+		Password:       form.Password,
 	}
 
 	if err := g.GalleryService.Create(&gallery); err != nil {
@@ -94,6 +171,12 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+// galleryIndex is what the index view is rendered with.
+type galleryIndex struct {
+	Galleries []*models.Gallery
+	Usage     *models.Usage
+}
+
 // GET /galleries
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
@@ -102,9 +185,25 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	for _, gallery := range galleries {
+		cover, err := g.ImageService.Cover(gallery)
+		if err != nil && err != models.ErrNotFound {
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		gallery.CoverImage = cover
+	}
+	usage, err := g.UsageService.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
 
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = galleryIndex{
+		Galleries: galleries,
+		Usage:     usage,
+	}
 	g.IndexView.Render(w, r, vd)
 }
 
@@ -121,6 +220,13 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	links, err := g.ShareLinkService.ByGalleryID(gallery.ID)
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	gallery.ShareLinks = links
+
 	var vd views.Data
 	vd.Yield = gallery
 	g.EditView.Render(w, r, vd)
@@ -150,10 +256,21 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	gallery.Title = form.Title
+	gallery.Visibility = form.Visibility
+	gallery.Password = form.Password
+	gallery.RemovePassword = form.RemovePassword
+	oldPolicy := gallery.Metadata()
+	gallery.MetadataPolicy = form.MetadataPolicy
 
 	if err = g.GalleryService.Update(gallery); err != nil {
 		vd.SetAlert(err)
 	} else {
+		if gallery.Metadata() != oldPolicy {
+			// the served copies need redoing to match the new setting
+			if err := g.ImageService.RegenerateGallery(gallery.ID); err != nil {
+				fmt.Printf("Failed to queue regenerating gallery %d: %s\n", gallery.ID, err)
+			}
+		}
 		vd.Alert = &views.Alert{
 			Level:   views.AlertLvlSuccess,
 			Message: "Gallery Updated Suceessfully!",
@@ -194,10 +311,13 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Moved " + gallery.Title + " to the trash, you can restore it from there.",
+	})
 }
 
-// POST /galleries/:id/images/:filename/delete
+// POST /galleries/:id/images/:name/delete
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
@@ -210,10 +330,9 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := mux.Vars(r)["filename"]
-	i := &models.Image{
-		Filename:  filename,
-		GalleryID: gallery.ID,
+	i, err := g.imageByName(w, r, gallery)
+	if err != nil {
+		return
 	}
 
 	var vd views.Data
@@ -224,6 +343,91 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Moved " + i.Filename + " to the trash, you can restore it from there.",
+	})
+}
+
+type ImageForm struct {
+	Caption string `schema:"caption"`
+	AltText string `schema:"alt_text"`
+}
+
+// POST /galleries/:id/images/:name/update
+func (g *Galleries) ImageUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+
+	i, err := g.imageByName(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ImageForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	i.Caption = form.Caption
+	i.AltText = form.AltText
+	if err := g.ImageService.Update(i); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// POST /galleries/:id/images/:name/cover
+func (g *Galleries) ImageCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+
+	i, err := g.imageByName(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	gallery.CoverImageID = i.ID
+	if err := g.GalleryService.Update(gallery); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = gallery
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
 		http.Redirect(w, r, "/galleries", http.StatusFound)
@@ -232,6 +436,63 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+type imageOrderRequest struct {
+	// Order is the storage names of the gallery's images, first to last.
+	Order []string `json:"order"`
+}
+
+// POST /galleries/:id/images/order
+//
+// Takes a JSON body like {"order": ["name1", "name2"]} so the edit page can
+// save the new order as soon as an image is dropped somewhere else.
+func (g *Galleries) ImageOrder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		writeJSONError(w, http.StatusForbidden, "You do not have permission to edit this gallery")
+		return
+	}
+
+	var req imageOrderRequest
+	if err := parseJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if err := g.ImageService.Reorder(gallery.ID, req.Order); err != nil {
+		if err == models.ErrImageOrderInvalid {
+			writeJSONError(w, http.StatusUnprocessableEntity, models.ErrImageOrderInvalid.Public())
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, views.AlertMessageGeneric)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// imageByName looks up the image named in the URL, writing the error
+// response itself if it can't be found.
+func (g *Galleries) imageByName(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+	name := mux.Vars(r)["name"]
+	i, err := g.ImageService.ByStorageName(gallery.ID, name)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		case models.ErrStorageNameInvalid:
+			http.Error(w, "Invalid image name", http.StatusBadRequest)
+		default:
+			http.Error(w, "Whoops! Something went wrong.",
+				http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return i, nil
+}
+
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseUint(vars["id"], 10, 32)
@@ -252,18 +513,29 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 		return nil, err
 	}
 
-	images, err := g.ImageService.ByGalleryID(gallery.ID)
-	if err != nil {
-		http.Error(w, "galleryById fed up: "+err.Error(), http.StatusNotFound)
+	if err := g.loadImages(w, gallery); err != nil {
 		return nil, err
 	}
+	return gallery, nil
+}
 
+func (g *Galleries) loadImages(w http.ResponseWriter, gallery *models.Gallery) error {
+	images, err := g.ImageService.ByGalleryID(gallery.ID)
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return err
+	}
 	gallery.Images = images
-	return gallery, nil
+	return nil
 }
 
 const maxMultipartMem = 1 << 20 // 1 mb
 
+// maxImageUpload is the most that can be sent in one go from the upload
+// form, room for 40 photos at the 25mb limit. Bigger batches should be
+// zipped and imported.
+const maxImageUpload = 1 << 30 // 1 gb
+
 // POST /galleries/:id/images
 func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
@@ -280,28 +552,122 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 
 	var vd views.Data
 	vd.Yield = gallery
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUpload)
 	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
-		vd.SetAlert(err)
+		vd.AlertError("That upload was too big or got cut off, upload at most 1GB at a time or import a zip")
 		g.EditView.Render(w, r, vd)
 		return
 	}
 
 	files := r.MultipartForm.File["images"]
+	results := make([]models.UploadResult, 0, len(files))
 	for _, f := range files {
-		file, err := f.Open()
-		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+		results = append(results, models.UploadResult{
+			Filename: f.Filename,
+			Err:      g.uploadOne(gallery, f),
+		})
+	}
+	g.showUploadResults(w, r, gallery, results)
+}
+
+// uploadOne adds a single file from the upload form to the gallery.
+func (g *Galleries) uploadOne(gallery *models.Gallery, f *multipart.FileHeader) error {
+	file, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	image := models.Image{
+		GalleryID: gallery.ID,
+		UserID:    gallery.UserID,
+		Filename:  f.Filename,
+	}
+	return g.ImageService.Create(&image, file)
+}
+
+// maxImportUpload is the biggest zip that can be uploaded to import.
+const maxImportUpload = 4 << 30 // 4 gb
+
+// POST /galleries/:id/images/import
+func (g *Galleries) ImageImport(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportUpload)
+	// anything past the first mb is spooled to a temp file, which is what
+	// lets zip jump around in it
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		vd.AlertError("That upload was too big or got cut off, zips can be at most 4GB")
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		vd.AlertError("Pick a zip of photos to import")
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	defer file.Close()
+
+	results, err := g.ImageService.Import(gallery, file, header.Size)
+	if err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.showUploadResults(w, r, gallery, results)
+}
+
+// showUploadResults sends the owner back to the edit page after a batch
+// upload. When everything went in it's just a redirect with a short note,
+// otherwise the page lists how each file went so they know which ones to
+// look at.
+func (g *Galleries) showUploadResults(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, results []models.UploadResult) {
+	var uploaded, failed int
+	var skipped []string
+	for _, res := range results {
+		switch {
+		case res.Skipped():
+			// re-uploading a whole card is common so these aren't failures
+			skipped = append(skipped, res.Filename)
+		case res.Failed():
+			failed++
+		default:
+			uploaded++
 		}
-		defer file.Close()
+	}
 
-		g.ImageService.Create(gallery.ID, file, f.Filename)
+	if failed > 0 {
+		if err := g.loadImages(w, gallery); err != nil {
+			return
+		}
+		links, err := g.ShareLinkService.ByGalleryID(gallery.ID)
 		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
 			return
 		}
+		gallery.ShareLinks = links
+		gallery.Uploads = results
+
+		var vd views.Data
+		vd.Yield = gallery
+		vd.Alert = &views.Alert{
+			Level: views.AlertLvlWarning,
+			Message: fmt.Sprintf("Uploaded %d of %d photos, %d couldn't be added. See below for why.",
+				uploaded, len(results), failed),
+		}
+		g.EditView.Render(w, r, vd)
+		return
 	}
 
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
@@ -309,5 +675,20 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
+	if len(skipped) > 0 {
+		views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+			Level: views.AlertLvlWarning,
+			Message: fmt.Sprintf("Uploaded %d photos and skipped %d that are already in this gallery: %s",
+				uploaded, len(skipped), strings.Join(skipped, ", ")),
+		})
+		return
+	}
+	if len(results) > 1 {
+		views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: fmt.Sprintf("Uploaded %d photos", uploaded),
+		})
+		return
+	}
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/url"
 
@@ -27,3 +29,21 @@ func parseValues(f url.Values, dst interface{}) error {
 	dec.IgnoreUnknownKeys(true)
 	return dec.Decode(dst, f)
 }
+
+// maxJSONBody is plenty for the small JSON requests the site takes.
+const maxJSONBody = 1 << 20 // 1 mb
+
+func parseJSON(r *http.Request, dst interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxJSONBody))
+	return dec.Decode(dst)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
+	"github.com/gorilla/mux"
+)
+
+func NewImages(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, signer *hash.URLSigner) *Images {
+	return &Images{
+		GalleryService:   gs,
+		ImageService:     is,
+		ShareLinkService: sls,
+		Signer:           signer,
+	}
+}
+
+// Images serves image files out of storage, checking the viewer is allowed
+// to see the gallery they belong to first.
+type Images struct {
+	GalleryService   models.GalleryService
+	ImageService     models.ImageService
+	ShareLinkService models.ShareLinkService
+	// Signer checks the signatures Image.SignedPath adds to URLs. It may be
+	// nil, in which case every request has to get in some other way.
+	Signer *hash.URLSigner
+}
+
+// GET|HEAD /images/galleries/:id/:name
+// GET /images/galleries/:id/public/:name
+// GET /images/galleries/:id/variants/:variant/:name.jpg
+//
+// Every file is looked up through its image row, so only files that belong
+// to an image in the gallery can ever be served and there is nothing like a
+// directory listing to stumble on. URLs with a valid signature are served to
+// anyone until they expire, otherwise the viewer has to be allowed to see
+// the gallery.
+func (i *Images) Serve(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := i.GalleryService.ByID(uint(id))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Unlisted galleries need the cookie their link sets, guessing an image
+	// name isn't enough. Private galleries are owner only.
+	user := context.User(r.Context())
+	owner := gallery.OwnedBy(user)
+	signed := i.signed(r)
+	if !signed && !gallery.CanView(user) && !unlisted(r, gallery) && !i.shared(r, gallery) {
+		// 404 rather than 403 so private galleries can't be discovered
+		http.NotFound(w, r)
+		return
+	}
+	if !signed && !galleryUnlocked(i.GalleryService, r, gallery) {
+		http.Error(w, "This gallery needs a password", http.StatusForbidden)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, fmt.Sprintf("/images/galleries/%d/", gallery.ID))
+	parts := strings.Split(rest, "/")
+	var name string
+	switch {
+	case len(parts) == 1:
+		name = parts[0]
+	case len(parts) == 2 && parts[0] == "public":
+		name = parts[1]
+	case len(parts) == 3 && parts[0] == "variants":
+		name = strings.TrimSuffix(parts[2], ".jpg")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	image, err := i.ImageService.ByStorageName(gallery.ID, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// sanitized copies are always the same type as the original and
+	// variants are always jpegs
+	key, contentType := "", image.ContentType
+	switch len(parts) {
+	case 1:
+		if key = originalKey(image, gallery, owner); key == "" {
+			http.NotFound(w, r)
+			return
+		}
+	case 2:
+		if !image.Sanitized {
+			http.NotFound(w, r)
+			return
+		}
+		key = image.SanitizedKey()
+	case 3:
+		if !image.HasVariant(parts[1]) {
+			http.NotFound(w, r)
+			return
+		}
+		key, contentType = image.VariantKey(parts[1]), "image/jpeg"
+	}
+
+	f, obj, err := i.ImageService.Open(key)
+	if err == storage.ErrNotExist {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if contentType == "" {
+		// rows from before we sniffed uploads
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etag(image, key, obj))
+	if gallery.IsPublic() && !gallery.IsProtected() {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	} else {
+		// shared caches shouldn't hang on to anything that isn't public
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	}
+	// ServeContent takes care of Range, If-None-Match and If-Modified-Since
+	http.ServeContent(w, r, "", obj.ModTime, f)
+}
+
+// originalKey is the file to send for the image's original. Only the owner
+// gets the original with everything still in it, everyone else gets the
+// sanitized copy, or nothing while it's still being made.
+func originalKey(image *models.Image, gallery *models.Gallery, owner bool) string {
+	if owner {
+		return image.Key()
+	}
+	return image.PublicKey(gallery.Metadata())
+}
+
+// etag identifies the exact bytes being served. Hashed originals already
+// have a content hash, anything else is identified by where it is, how big
+// it is and when it was written, which changes whenever it is regenerated.
+func etag(image *models.Image, key string, obj storage.Object) string {
+	if key == image.Key() && image.SHA256 != "" {
+		return `"` + image.SHA256 + `"`
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", key, obj.Size, obj.ModTime.UnixNano())))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// signed is true if the URL was signed by Image.SignedPath and hasn't
+// expired.
+// Expired URLs and ones signed with a key that has since been rotated out
+// are just treated as unsigned, so a viewer who can still see the gallery
+// doesn't notice.
+func (i *Images) signed(r *http.Request) bool {
+	if i.Signer == nil {
+		return false
+	}
+	return i.Signer.Verify(r.URL.EscapedPath(), r.URL.Query(), time.Now()) == nil
+}
+
+// unlisted is true if the visitor opened the unlisted gallery with its
+// current link. Changing the link locks out anyone who had the old one.
+func unlisted(r *http.Request, gallery *models.Gallery) bool {
+	cookie, err := r.Cookie(unlistedCookieName(gallery.ID))
+	if err != nil {
+		return false
+	}
+	return gallery.ShareTokenMatches(cookie.Value)
+}
+
+// shared is true if the visitor opened the gallery with a share link that
+// still works.
+func (i *Images) shared(r *http.Request, gallery *models.Gallery) bool {
+	cookie, err := r.Cookie(shareCookieName(gallery.ID))
+	if err != nil {
+		return false
+	}
+	return i.ShareLinkService.Check(gallery.ID, cookie.Value)
+}
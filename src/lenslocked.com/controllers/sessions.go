@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+const Account = "account"
+
+type accountPage struct {
+	Sessions []models.Session
+	// CurrentSessionID is the session the page is being looked at with.
+	CurrentSessionID uint
+	TwoFactorEnabled bool
+}
+
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	sessions, err := u.SessionService.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	page := accountPage{
+		Sessions:         sessions,
+		TwoFactorEnabled: user.TwoFactorEnabled(),
+	}
+	if session := context.Session(r.Context()); session != nil {
+		page.CurrentSessionID = session.ID
+	}
+
+	var vd views.Data
+	vd.Yield = page
+	u.AccountView.Render(w, r, vd)
+}
+
+// POST /account/sessions/:id/revoke
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	session, err := u.SessionService.ByID(uint(id))
+	if err == nil && session.UserID != user.ID {
+		err = models.ErrNotFound
+	}
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		// most likely already revoked from somewhere else
+		u.accountRedirect(w, r, views.AlertLvlWarning, "That session has already ended.")
+		return
+	default:
+		u.accountRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+
+	if current := context.Session(r.Context()); current != nil && current.ID == session.ID {
+		// same as logging out
+		u.Logout(w, r)
+		return
+	}
+	if err := u.SessionService.Delete(session.ID); err != nil {
+		u.accountRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+	u.accountRedirect(w, r, views.AlertLvlSuccess, fmt.Sprintf("Logged out %s.", session.Device()))
+}
+
+// POST /account/sessions/revoke-others
+func (u *Users) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var current uint
+	if session := context.Session(r.Context()); session != nil {
+		current = session.ID
+	}
+	n, err := u.SessionService.DeleteByUserID(user.ID, current)
+	if err != nil {
+		u.accountRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+	u.accountRedirect(w, r, views.AlertLvlSuccess, fmt.Sprintf("Logged out of %d other sessions.", n))
+}
+
+func (u *Users) accountRedirect(w http.ResponseWriter, r *http.Request, level, message string) {
+	path := "/account"
+	if url, err := u.r.Get(Account).URL(); err == nil {
+		path = url.Path
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   level,
+		Message: message,
+	})
+}
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+)
+
+const AccountSettings = "account_settings"
+
+type SettingsForm struct {
+	Name            string `schema:"name"`
+	Email           string `schema:"email"`
+	CurrentPassword string `schema:"current_password"`
+	NewPassword     string `schema:"new_password"`
+}
+
+// settingsPage is what the settings view is rendered with.
+type settingsPage struct {
+	Name          string
+	Email         string
+	EmailVerified bool
+	// PendingEmail is the address they're changing to but haven't
+	// confirmed yet.
+	PendingEmail string
+	// NewEmail refills the change email form after a mistake.
+	NewEmail string
+}
+
+// GET /account/settings
+func (u *Users) Settings(w http.ResponseWriter, r *http.Request) {
+	u.renderSettings(w, r, views.Data{}, "")
+}
+
+// POST /account/settings/name
+func (u *Users) UpdateName(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form SettingsForm
+	if err := parseForm(r, &form); err != nil {
+		u.settingsRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+	user.Name = strings.TrimSpace(form.Name)
+	if err := u.UserService.Update(user); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd, "")
+		return
+	}
+	u.settingsRedirect(w, r, views.AlertLvlSuccess, "Name updated.")
+}
+
+// POST /account/settings/email
+func (u *Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form SettingsForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd, "")
+		return
+	}
+
+	token, newEmail, err := u.UserService.InitiateEmailChange(user, form.Email, form.CurrentPassword)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd, form.Email)
+		return
+	}
+	if err := u.Email.SendEmailChangeEmail(newEmail, token); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd, form.Email)
+		return
+	}
+	if err := u.Email.SendEmailChangeNoticeEmail(user.Email, newEmail); err != nil {
+		// the change still needs the link, so carry on
+		fmt.Printf("Error sending email change notice to user %d: %s\n", user.ID, err)
+	}
+	u.settingsRedirect(w, r, views.AlertLvlSuccess,
+		fmt.Sprintf("We sent a link to %s. Your email address will change once you follow it.", newEmail))
+}
+
+// POST /account/settings/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form SettingsForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd, "")
+		return
+	}
+	if err := u.UserService.ChangePassword(user, form.CurrentPassword, form.NewPassword); err != nil {
+		vd.SetAlert(err)
+		u.renderSettings(w, r, vd, "")
+		return
+	}
+
+	// same as a reset, anyone who knew the old password is logged out,
+	// except this device
+	var current uint
+	if session := context.Session(r.Context()); session != nil {
+		current = session.ID
+	}
+	if _, err := u.SessionService.DeleteByUserID(user.ID, current); err != nil {
+		fmt.Printf("Failed to log user %d out after a password change: %s\n", user.ID, err)
+	}
+	u.settingsRedirect(w, r, views.AlertLvlSuccess, "Password changed. You've been logged out everywhere else.")
+}
+
+func (u *Users) renderSettings(w http.ResponseWriter, r *http.Request, vd views.Data, newEmail string) {
+	user := context.User(r.Context())
+	pending, err := u.UserService.PendingEmail(user)
+	if err != nil {
+		// only shown as a reminder, not worth failing the page over
+		fmt.Printf("Failed to look up pending email for user %d: %s\n", user.ID, err)
+	}
+	vd.Yield = settingsPage{
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified(),
+		PendingEmail:  pending,
+		NewEmail:      newEmail,
+	}
+	u.SettingsView.Render(w, r, vd)
+}
+
+func (u *Users) settingsRedirect(w http.ResponseWriter, r *http.Request, level, message string) {
+	path := "/account/settings"
+	if url, err := u.r.Get(AccountSettings).URL(); err == nil {
+		path = url.Path
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   level,
+		Message: message,
+	})
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+type ShareLinkForm struct {
+	Label string `schema:"label"`
+	// ExpiresIn is in days, zero means never.
+	ExpiresIn int `schema:"expires_in"`
+	MaxViews  int `schema:"max_views"`
+}
+
+// POST /galleries/:id/shares
+func (g *Galleries) ShareCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = gallery
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	link := models.ShareLink{
+		GalleryID: gallery.ID,
+		Label:     form.Label,
+		MaxViews:  form.MaxViews,
+	}
+	if form.ExpiresIn > 0 {
+		expires := time.Now().AddDate(0, 0, form.ExpiresIn)
+		link.ExpiresAt = &expires
+	}
+	if err := g.ShareLinkService.Create(&link); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	// we only keep a hash of the token so this is the one chance to copy it
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Share link created, copy it now since it won't be shown again: /s/%s", link.Token),
+	})
+}
+
+// POST /galleries/:id/shares/:share_id/revoke
+func (g *Galleries) ShareRevoke(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "You do not have permission to edit this gallery", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["share_id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	link, err := g.ShareLinkService.ByID(uint(id))
+	if err != nil || link.GalleryID != gallery.ID {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	var vd views.Data
+	if err := g.ShareLinkService.Delete(link.ID); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = gallery
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// GET /s/:token
+//
+// Opening a share link counts a view and shows the gallery read only, no
+// matter its visibility. The token is also left in a cookie scoped to the
+// gallery's images so they load for the visitor, see shareCookieName.
+func (g *Galleries) ShareShow(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	link, err := g.ShareLinkService.ByToken(token)
+	if err == nil && link.Expired() {
+		err = models.ErrShareLinkExpired
+	}
+	if err == nil && link.UsedUp() {
+		err = models.ErrShareLinkUsedUp
+	}
+	var gallery *models.Gallery
+	if err == nil {
+		gallery, err = g.GalleryService.ByID(link.GalleryID)
+	}
+	if err == nil && !galleryUnlocked(g.GalleryService, r, gallery) {
+		// a password page shouldn't use up one of the link's views
+		g.requireUnlocked(w, r, gallery)
+		return
+	}
+	if err == nil {
+		link, err = g.ShareLinkService.Redeem(token)
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "This share link doesn't exist or has been revoked", http.StatusNotFound)
+		case models.ErrShareLinkExpired, models.ErrShareLinkUsedUp:
+			http.Error(w, err.(views.PublicError).Public(), http.StatusGone)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := g.loadImages(w, gallery); err != nil {
+		return
+	}
+
+	cookie := http.Cookie{
+		Name:     shareCookieName(gallery.ID),
+		Value:    token,
+		Path:     fmt.Sprintf("/images/galleries/%d/", gallery.ID),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if link.ExpiresAt != nil {
+		cookie.Expires = *link.ExpiresAt
+	}
+	http.SetCookie(w, &cookie)
+	gallery.DownloadPath = path.Join(r.URL.Path, "download")
+
+	var vd views.Data
+	vd.Yield = gallery
+	g.ShowView.Render(w, r, vd)
+}
+
+// shareCookieName is the cookie holding the share link token a visitor
+// used to open the gallery.
+func shareCookieName(galleryID uint) string {
+	return fmt.Sprintf("share_%d", galleryID)
+}
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+const TrashIndex = "trash_index"
+
+type trashPage struct {
+	Galleries []trashedGallery
+	Images    []trashedImage
+	// RetentionDays is how long things stay in the trash, 0 for forever.
+	RetentionDays int
+}
+
+type trashedGallery struct {
+	*models.Gallery
+	PurgeOn string
+}
+
+type trashedImage struct {
+	models.Image
+	GalleryTitle string
+	PurgeOn      string
+}
+
+// purgeOn is the day something deleted at deletedAt gets purged, or "" if
+// it never will be.
+func (g *Galleries) purgeOn(deletedAt *time.Time) string {
+	if g.TrashRetention == 0 || deletedAt == nil {
+		return ""
+	}
+	return deletedAt.Add(g.TrashRetention).Format("Jan 2, 2006")
+}
+
+// GET /trash
+func (g *Galleries) Trash(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := g.GalleryService.TrashedByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	images, err := g.ImageService.TrashedByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// trashed images are only listed when their gallery isn't, so it's
+	// always one of these
+	live, err := g.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	titles := make(map[uint]string, len(live))
+	for _, gallery := range live {
+		titles[gallery.ID] = gallery.Title
+	}
+
+	page := trashPage{
+		RetentionDays: int(g.TrashRetention / (24 * time.Hour)),
+	}
+	for _, gallery := range galleries {
+		page.Galleries = append(page.Galleries, trashedGallery{
+			Gallery: gallery,
+			PurgeOn: g.purgeOn(gallery.DeletedAt),
+		})
+	}
+	for _, image := range images {
+		page.Images = append(page.Images, trashedImage{
+			Image:        image,
+			GalleryTitle: titles[image.GalleryID],
+			PurgeOn:      g.purgeOn(image.DeletedAt),
+		})
+	}
+
+	var vd views.Data
+	vd.Yield = page
+	g.TrashView.Render(w, r, vd)
+}
+
+// POST /trash/galleries/:id/restore
+func (g *Galleries) TrashRestoreGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.trashedGalleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := g.GalleryService.Restore(gallery.ID); err != nil {
+		g.trashRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+	g.trashRedirect(w, r, views.AlertLvlSuccess, "Restored "+gallery.Title+".")
+}
+
+// POST /trash/galleries/:id/purge
+func (g *Galleries) TrashPurgeGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.trashedGalleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := g.GalleryService.Purge(gallery.ID); err != nil {
+		g.trashRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+	g.trashRedirect(w, r, views.AlertLvlSuccess, gallery.Title+" has been deleted for good.")
+}
+
+// POST /trash/images/:id/restore
+func (g *Galleries) TrashRestoreImage(w http.ResponseWriter, r *http.Request) {
+	image, err := g.trashedImageByID(w, r)
+	if err != nil {
+		return
+	}
+	err = g.ImageService.Restore(image)
+	if err == models.ErrNotFound {
+		g.trashRedirect(w, r, views.AlertLvlError, "The gallery this photo was in has been deleted, restore it first.")
+		return
+	}
+	if err != nil {
+		g.trashRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+	g.trashRedirect(w, r, views.AlertLvlSuccess, "Restored "+image.Filename+".")
+}
+
+// POST /trash/images/:id/purge
+func (g *Galleries) TrashPurgeImage(w http.ResponseWriter, r *http.Request) {
+	image, err := g.trashedImageByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := g.ImageService.Purge(image); err != nil {
+		g.trashRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+	g.trashRedirect(w, r, views.AlertLvlSuccess, image.Filename+" has been deleted for good.")
+}
+
+func (g *Galleries) trashRedirect(w http.ResponseWriter, r *http.Request, level, message string) {
+	path := "/trash"
+	if url, err := g.r.Get(TrashIndex).URL(); err == nil {
+		path = url.Path
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   level,
+		Message: message,
+	})
+}
+
+// trashedGalleryByID looks up the current user's gallery in the trash from
+// the URL, writing the error response itself if there isn't one.
+func (g *Galleries) trashedGalleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return nil, err
+	}
+	gallery, err := g.GalleryService.TrashedByID(uint(id))
+	if err == nil && gallery.UserID != context.User(r.Context()).ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return gallery, nil
+}
+
+// trashedImageByID is trashedGalleryByID for images.
+func (g *Galleries) trashedImageByID(w http.ResponseWriter, r *http.Request) (*models.Image, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return nil, err
+	}
+	image, err := g.ImageService.TrashedByID(uint(id))
+	if err == nil && image.UserID != context.User(r.Context()).ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return image, nil
+}
@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	TwoFactorLogin = "two_factor_login"
+	TwoFactor      = "two_factor"
+
+	// twoFactorCookie remembers who got their password right while they
+	// find their code.
+	twoFactorCookie = "two_factor"
+)
+
+type TwoFactorForm struct {
+	Code string `schema:"code"`
+	// Secret is only used when turning two factor on, it goes back and
+	// forth in the form so nothing is saved until the code checks out.
+	Secret string `schema:"secret"`
+}
+
+// twoFactorPage is what the two factor settings view is rendered with.
+type twoFactorPage struct {
+	Enabled bool
+	// for turning it on
+	Secret string
+	QRCode template.URL
+	// for once it's on
+	RecoveryCodesLeft int
+	// RecoveryCodes is only set right after turning it on, the one time
+	// they can be shown.
+	RecoveryCodes []string
+}
+
+// startTwoFactor sends someone who got their password right on to enter
+// their code, instead of signing them in.
+func (u *Users) startTwoFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    u.UserService.StartTwoFactorLogin(user),
+		Path:     "/",
+		Expires:  time.Now().Add(models.TwoFactorLoginDuration),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	path := "/login/2fa"
+	if url, err := u.r.Get(TwoFactorLogin).URL(); err == nil {
+		path = url.Path
+	}
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
+// GET /login/2fa
+func (u *Users) TwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if _, err := u.twoFactorUser(r); err != nil {
+		u.loginRedirect(w, r, err)
+		return
+	}
+	u.TwoFactorLoginView.Render(w, r, nil)
+}
+
+// POST /login/2fa
+func (u *Users) CompleteTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	user, err := u.twoFactorUser(r)
+	if err != nil {
+		u.loginRedirect(w, r, err)
+		return
+	}
+
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	if err := u.UserService.VerifyTOTP(user, form.Code); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+	})
+
+	url, err := u.r.Get(IndexGalleries).URL()
+	if err != nil {
+		vd.AlertError(fmt.Sprintf("Something went wrong: %s", err))
+		views.RedirectAlert(w, r, "/", http.StatusFound, *vd.Alert)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Welcome to Lenslocked.com, %s!", user.Name),
+	})
+}
+
+// twoFactorUser is who is part way through logging in.
+func (u *Users) twoFactorUser(r *http.Request) (*models.User, error) {
+	cookie, err := r.Cookie(twoFactorCookie)
+	if err != nil {
+		return nil, models.ErrTwoFactorLoginExpired
+	}
+	return u.UserService.TwoFactorLogin(cookie.Value)
+}
+
+func (u *Users) loginRedirect(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, "/login", http.StatusFound, *vd.Alert)
+}
+
+// GET /account/2fa
+func (u *Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	page, err := u.twoFactorPage(user, "")
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = page
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// POST /account/2fa/enable
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	codes, err := u.UserService.EnableTOTP(user, form.Secret, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		// same secret again, they've likely already scanned it
+		page, pageErr := u.twoFactorPage(user, form.Secret)
+		if pageErr != nil {
+			vd.SetAlert(pageErr)
+		}
+		vd.Yield = page
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two factor authentication is on. Save your recovery codes somewhere safe, they won't be shown again.",
+	}
+	vd.Yield = twoFactorPage{
+		Enabled:           true,
+		RecoveryCodes:     codes,
+		RecoveryCodesLeft: len(codes),
+	}
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// POST /account/2fa/disable
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		u.twoFactorRedirect(w, r, views.AlertLvlError, views.AlertMessageGeneric)
+		return
+	}
+	if err := u.UserService.DisableTOTP(user, form.Code); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.twoFactorRedirect(w, r, vd.Alert.Level, vd.Alert.Message)
+		return
+	}
+	u.twoFactorRedirect(w, r, views.AlertLvlSuccess, "Two factor authentication is off.")
+}
+
+// twoFactorPage sets up the settings page for user, making a new secret to
+// scan unless one is given.
+func (u *Users) twoFactorPage(user *models.User, secret string) (twoFactorPage, error) {
+	if user.TwoFactorEnabled() {
+		left, err := u.UserService.RecoveryCodesLeft(user)
+		return twoFactorPage{Enabled: true, RecoveryCodesLeft: left}, err
+	}
+
+	var page twoFactorPage
+	if secret == "" {
+		var err error
+		if secret, err = u.UserService.NewTOTPSecret(user); err != nil {
+			return page, err
+		}
+	}
+	png, err := qrcode.Encode(u.UserService.TOTPURI(user, secret), qrcode.Medium, 256)
+	if err != nil {
+		return page, err
+	}
+	page.Secret = secret
+	page.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	return page, nil
+}
+
+func (u *Users) twoFactorRedirect(w http.ResponseWriter, r *http.Request, level, message string) {
+	path := "/account/2fa"
+	if url, err := u.r.Get(TwoFactor).URL(); err == nil {
+		path = url.Path
+	}
+	views.RedirectAlert(w, r, path, http.StatusFound, views.Alert{
+		Level:   level,
+		Message: message,
+	})
+}
@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+)
+
+type UnlockForm struct {
+	Password string `schema:"password"`
+	// Next is where to send the visitor once the gallery is unlocked, so
+	// they end up back on whichever link they came in with.
+	Next string `schema:"next"`
+}
+
+// unlockPage is what the unlock view is rendered with.
+type unlockPage struct {
+	Gallery *models.Gallery
+	Next    string
+}
+
+// POST /galleries/:id/unlock
+func (g *Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var form UnlockForm
+	if err := parseForm(r, &form); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	next := form.Next
+	// only ever redirect within the site
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = fmt.Sprintf("/galleries/show/%d", gallery.ID)
+	}
+	if !gallery.IsProtected() {
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+
+	value, err := g.GalleryService.Unlock(gallery, form.Password, context.IP(r.Context()))
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		vd.Yield = unlockPage{Gallery: gallery, Next: next}
+		if err == models.ErrGalleryUnlockThrottled {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(gallery.ID),
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Now().Add(models.GalleryUnlockDuration),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// requireUnlocked renders the password form and returns false if the
+// gallery has a password the visitor hasn't entered yet. Owners never need
+// to unlock their own galleries.
+func (g *Galleries) requireUnlocked(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) bool {
+	if galleryUnlocked(g.GalleryService, r, gallery) {
+		return true
+	}
+	var vd views.Data
+	vd.Yield = unlockPage{Gallery: gallery, Next: r.URL.Path}
+	g.UnlockView.Render(w, r, vd)
+	return false
+}
+
+// galleryUnlocked is true if the gallery has no password, the visitor owns
+// it or they have entered the password recently.
+func galleryUnlocked(gs models.GalleryService, r *http.Request, gallery *models.Gallery) bool {
+	if !gallery.IsProtected() || gallery.OwnedBy(context.User(r.Context())) {
+		return true
+	}
+	cookie, err := r.Cookie(unlockCookieName(gallery.ID))
+	if err != nil {
+		return false
+	}
+	return gs.Unlocked(gallery, cookie.Value)
+}
+
+func unlockCookieName(galleryID uint) string {
+	return fmt.Sprintf("unlock_%d", galleryID)
+}
@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+// The resumable upload api, used by assets/chunked_upload.js. An upload is
+// started with the file's name and size, then sent in chunks of up to
+// chunk_size bytes, each with its SHA-256 in the X-Chunk-SHA256 header.
+// If the connection drops the client asks where the upload got to and
+// carries on from there. Once every byte is in, finishing it adds the photo
+// to the gallery.
+//
+//	POST   /galleries/:id/uploads                     {"filename", "size", "sha256"}
+//	GET    /galleries/:id/uploads/:upload_id
+//	PUT    /galleries/:id/uploads/:upload_id?offset=n  raw chunk bytes
+//	POST   /galleries/:id/uploads/:upload_id/finish
+//	DELETE /galleries/:id/uploads/:upload_id
+
+type uploadStartRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	// SHA256 of the whole file is optional, the chunks are always checked.
+	SHA256 string `json:"sha256"`
+}
+
+type uploadStatus struct {
+	ID        uint  `json:"id"`
+	Offset    int64 `json:"offset"`
+	Size      int64 `json:"size"`
+	ChunkSize int64 `json:"chunk_size"`
+}
+
+func newUploadStatus(upload *models.UploadSession) uploadStatus {
+	return uploadStatus{
+		ID:        upload.ID,
+		Offset:    upload.Received,
+		Size:      upload.Size,
+		ChunkSize: models.MaxUploadChunk,
+	}
+}
+
+// POST /galleries/:id/uploads
+func (g *Galleries) UploadStart(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Gallery not found")
+		return
+	}
+	gallery, err := g.GalleryService.ByID(uint(id))
+	if err != nil || gallery.UserID != context.User(r.Context()).ID {
+		writeJSONError(w, http.StatusNotFound, "Gallery not found")
+		return
+	}
+
+	var req uploadStartRequest
+	if err := parseJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	upload := models.UploadSession{
+		UserID:    gallery.UserID,
+		GalleryID: gallery.ID,
+		Filename:  req.Filename,
+		Size:      req.Size,
+		SHA256:    req.SHA256,
+	}
+	if err := g.UploadService.Start(&upload); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newUploadStatus(&upload))
+}
+
+// GET /galleries/:id/uploads/:upload_id
+func (g *Galleries) UploadStatus(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, newUploadStatus(upload))
+}
+
+// PUT /galleries/:id/uploads/:upload_id?offset=n
+func (g *Galleries) UploadAppend(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "The offset the chunk starts at is required")
+		return
+	}
+
+	err = g.UploadService.Append(upload, offset, r.Header.Get("X-Chunk-SHA256"), r.Body)
+	if err == models.ErrUploadOffsetMismatch {
+		// let the client know where to pick up from, eg when it's resending
+		// a chunk we got but it never heard back about
+		current, err := g.UploadService.ByID(upload.ID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, views.AlertMessageGeneric)
+			return
+		}
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":  models.ErrUploadOffsetMismatch.Public(),
+			"offset": current.Received,
+		})
+		return
+	}
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUploadStatus(upload))
+}
+
+// POST /galleries/:id/uploads/:upload_id/finish
+func (g *Galleries) UploadFinish(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	image, err := g.UploadService.Finish(upload)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"name":     image.StorageName,
+		"filename": image.Filename,
+	})
+}
+
+// DELETE /galleries/:id/uploads/:upload_id
+func (g *Galleries) UploadCancel(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := g.UploadService.Cancel(upload); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, views.AlertMessageGeneric)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadByID looks up the upload in the URL, making sure it belongs to the
+// current user and the gallery in the URL. It writes the error response
+// itself if not.
+func (g *Galleries) uploadByID(w http.ResponseWriter, r *http.Request) (*models.UploadSession, error) {
+	vars := mux.Vars(r)
+	galleryID, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Upload not found")
+		return nil, err
+	}
+	id, err := strconv.ParseUint(vars["upload_id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Upload not found")
+		return nil, err
+	}
+	upload, err := g.UploadService.ByID(uint(id))
+	if err == nil && (upload.UserID != context.User(r.Context()).ID || upload.GalleryID != uint(galleryID)) {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			writeJSONError(w, http.StatusNotFound, "Upload not found")
+		default:
+			writeJSONError(w, http.StatusInternalServerError, views.AlertMessageGeneric)
+		}
+		return nil, err
+	}
+	return upload, nil
+}
+
+// writeUploadError sends validation errors back for the client to show,
+// anything else is on us.
+func writeUploadError(w http.ResponseWriter, err error) {
+	if pErr, ok := err.(views.PublicError); ok {
+		writeJSONError(w, http.StatusUnprocessableEntity, pErr.Public())
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, views.AlertMessageGeneric)
+}
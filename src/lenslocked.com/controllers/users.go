@@ -8,31 +8,40 @@ import (
 	"github.com/eitah/lenslocked/src/lenslocked.com/context"
 	"github.com/eitah/lenslocked/src/lenslocked.com/email"
 	"github.com/eitah/lenslocked/src/lenslocked.com/models"
-	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
 	"github.com/eitah/lenslocked/src/lenslocked.com/views"
 	"github.com/gorilla/mux"
 )
 
-func NewUsers(us models.UserService, emailClient email.EmailClient, r *mux.Router) *Users {
+func NewUsers(us models.UserService, ss models.SessionService, mailer email.Mailer, r *mux.Router) *Users {
 	return &Users{
-		NewView:      views.NewView("bootstrap", "users/new"),
-		LoginView:    views.NewView("bootstrap", "users/login"),
-		ForgotPWView: views.NewView("bootstrap", "users/forgot_pw"),
-		ResetPWView:  views.NewView("bootstrap", "users/reset_pw"),
-		UserService:  us,
-		Email:        emailClient,
-		r:            r,
+		NewView:            views.NewView("bootstrap", "users/new"),
+		LoginView:          views.NewView("bootstrap", "users/login"),
+		ForgotPWView:       views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPWView:        views.NewView("bootstrap", "users/reset_pw"),
+		AccountView:        views.NewView("bootstrap", "users/account"),
+		SettingsView:       views.NewView("bootstrap", "users/settings"),
+		TwoFactorView:      views.NewView("bootstrap", "users/two_factor"),
+		TwoFactorLoginView: views.NewView("bootstrap", "users/login_2fa"),
+		UserService:        us,
+		SessionService:     ss,
+		Email:              mailer,
+		r:                  r,
 	}
 }
 
 type Users struct {
-	NewView      *views.View
-	LoginView    *views.View
-	ForgotPWView *views.View
-	ResetPWView  *views.View
-	UserService  models.UserService
-	Email        email.EmailClient
-	r            *mux.Router
+	NewView            *views.View
+	LoginView          *views.View
+	ForgotPWView       *views.View
+	ResetPWView        *views.View
+	AccountView        *views.View
+	SettingsView       *views.View
+	TwoFactorView      *views.View
+	TwoFactorLoginView *views.View
+	UserService        models.UserService
+	SessionService     models.SessionService
+	Email              email.Mailer
+	r                  *mux.Router
 }
 
 type SignupForm struct {
@@ -87,16 +96,20 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := u.signIn(w, &user); err != nil {
+	if err := u.signIn(w, r, &user); err != nil {
 		// we assume its soem short lived data outage and so try to let users just proceed.
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	if err := u.Email.SendWelcomeEmail(); err != nil {
+	if err := u.Email.SendWelcomeEmail(user.Email); err != nil {
 		fmt.Printf("Error sending welcome email: %s\n", err)
 		// continuing because this is not a fatal error
 	}
+	if err := u.sendVerification(&user); err != nil {
+		// they can ask for another from the banner
+		fmt.Printf("Error sending verification email: %s\n", err)
+	}
 
 	url, err := u.r.Get(IndexGalleries).URL()
 	if err != nil {
@@ -136,8 +149,12 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		u.LoginView.Render(w, r, vd)
 		return
 	}
+	if user.TwoFactorEnabled() {
+		u.startTwoFactor(w, r, user)
+		return
+	}
 
-	if err := u.signIn(w, user); err != nil {
+	if err := u.signIn(w, r, user); err != nil {
 		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
 		return
@@ -155,49 +172,55 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Logout is used to delete a user's session cookie and invalidate their
-// current remember token, which will sign the current user out.
+// Logout is used to delete a user's session cookie and end the session it
+// was for, which signs them out on this device only.
 //
 // POST /logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	// First expire the users cookie
 	cookie := http.Cookie{
-		Name:     "remember_token",
+		Name:     models.SessionCookie,
 		Value:    "",
-		Expires:  time.Now(),
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
 		HttpOnly: true,
 	}
 	http.SetCookie(w, &cookie)
-	// then we add a new remember token
-	user := context.User(r.Context())
-	// ignore errors because they are 1) unlikely and 2) we cant recover now that
-	// we don't have a valid cookie
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.UserService.Update(user)
+	// then end the session so the token is no good even if it was copied
+	if session := context.Session(r.Context()); session != nil {
+		// ignore errors because they are 1) unlikely and 2) the cookie is
+		// gone either way and the session expires on its own eventually
+		u.SessionService.Delete(session.ID)
+	}
 	// Send the user to the home page
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		if err := u.UserService.Update(user); err != nil {
-			return err
-		}
+// signIn starts a new session for the user on this device. Each device
+// gets its own, so logging out of one leaves the others alone.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+	}
+	if err := u.SessionService.Create(&session); err != nil {
+		return err
+	}
+	if old := context.Session(r.Context()); old != nil {
+		// logging in again as someone else, or the same person, replaces
+		// whatever session this device had
+		u.SessionService.Delete(old.ID)
+	}
 
-		cookie := http.Cookie{
-			Name:     "remember_token",
-			Value:    user.Remember,
-			HttpOnly: true, // tells the cookie that it is not available to scripts.
-		}
-		http.SetCookie(w, &cookie)
-		return nil
+	cookie := http.Cookie{
+		Name:     models.SessionCookie,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true, // tells the cookie that it is not available to scripts.
+		SameSite: http.SameSiteLaxMode,
 	}
+	http.SetCookie(w, &cookie)
 	return nil
 }
 
@@ -210,13 +233,13 @@ func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
 
 // CookieTest is a dev method to see what our cookies like without needing to muck around in devtools
 func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+	cookie, err := r.Cookie(models.SessionCookie)
 	if err != nil {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		fmt.Fprintln(w, "<header><meta http-equiv=\"refresh\" content=\"2;url=/login\" /></header><body>Please log in, redirecting to '/login' in 2... 1...</body>")
 		return
 	}
-	fmt.Fprintln(w, "remember me token is:", cookie.Value)
+	fmt.Fprintln(w, "session token is:", cookie.Value)
 }
 
 type ResetPWForm struct {
@@ -243,7 +266,7 @@ func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := u.Email.SendForgotPasswordEmail(token); err != nil {
+	if err := u.Email.SendForgotPasswordEmail(form.Email, token); err != nil {
 		vd.SetAlert(err)
 		u.ForgotPWView.Render(w, r, vd)
 		return
@@ -273,7 +296,17 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 		u.ResetPWView.Render(w, r, vd)
 		return
 	}
-	u.signIn(w, user)
+	// whoever knew the old password could still be logged in somewhere, so
+	// everyone starts over with the new one
+	if _, err := u.SessionService.DeleteByUserID(user.ID, 0); err != nil {
+		fmt.Printf("Failed to log user %d out after a password reset: %s\n", user.ID, err)
+	}
+	if user.TwoFactorEnabled() {
+		// the reset email only stands in for the password, not the code
+		u.startTwoFactor(w, r, user)
+		return
+	}
+	u.signIn(w, r, user)
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
 		Level:   views.AlertLvlSuccess,
 		Message: fmt.Sprintf("Password changed successfully! Enjoy our site, %s", user.Name),
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+)
+
+// GET /verify?token=
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	// not necessarily logged in, the link could be opened on another device
+	next := "/login"
+	if context.User(r.Context()) != nil {
+		next = "/account"
+	}
+
+	user, err := u.UserService.CompleteVerification(r.URL.Query().Get("token"))
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, next, http.StatusFound, *vd.Alert)
+		return
+	}
+	views.RedirectAlert(w, r, next, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Thanks, %s is verified!", user.Email),
+	})
+}
+
+// POST /verify/resend
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.sendVerification(user); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.accountRedirect(w, r, vd.Alert.Level, vd.Alert.Message)
+		return
+	}
+	u.accountRedirect(w, r, views.AlertLvlSuccess, fmt.Sprintf("We sent a new link to %s.", user.Email))
+}
+
+// sendVerification emails the user a link to verify their address.
+func (u *Users) sendVerification(user *models.User) error {
+	token, err := u.UserService.InitiateVerification(user)
+	if err != nil {
+		return err
+	}
+	return u.Email.SendVerificationEmail(user.Email, token)
+}
@@ -7,11 +7,23 @@ import (
 	"gopkg.in/mailgun/mailgun-go.v1"
 )
 
+// Mailer is everything the app needs to send email. EmailClient sends
+// right away while Queue hands the email off to the background workers.
+type Mailer interface {
+	SendWelcomeEmail(to string) error
+	SendForgotPasswordEmail(to, token string) error
+	SendVerificationEmail(to, token string) error
+	SendEmailChangeEmail(to, token string) error
+	SendEmailChangeNoticeEmail(to, newEmail string) error
+}
+
 type EmailClient struct {
 	client           mailgun.Mailgun
 	elisEmailAddress string
 }
 
+var _ Mailer = &EmailClient{}
+
 func NewEmailClient(domain, apikey, publickey, elisEmailAddress string) EmailClient {
 	return EmailClient{
 		client:           mailgun.NewMailgun(domain, apikey, publickey),
@@ -19,7 +31,16 @@ func NewEmailClient(domain, apikey, publickey, elisEmailAddress string) EmailCli
 	}
 }
 
-func (m *EmailClient) SendWelcomeEmail() error {
+// recipient is who an email to the given address should actually go to.
+func (m *EmailClient) recipient(to string) string {
+	// todo only sends email to me because, well, its a free account
+	if m.elisEmailAddress != "" {
+		return m.elisEmailAddress
+	}
+	return to
+}
+
+func (m *EmailClient) SendWelcomeEmail(to string) error {
 	from := "support@lenslocked.com"
 	subject := "Welcome to lenslocked!"
 	text := `
@@ -28,8 +49,7 @@ func (m *EmailClient) SendWelcomeEmail() error {
 
 	Enjoy,
 	Lenslocked Support`
-	to := m.elisEmailAddress // todo only sends email to me because, well, its a free account
-	msg := m.client.NewMessage(from, subject, text, to)
+	msg := m.client.NewMessage(from, subject, text, m.recipient(to))
 	_, _, err := m.client.Send(msg)
 	if err != nil {
 		return err
@@ -56,10 +76,9 @@ const resetBaseURL = "https://itah-lenslocked.herokuapp.com/reset"
 
 // const resetBaseURL = "localhost:3000/reset"
 
-func (m *EmailClient) SendForgotPasswordEmail(token string) error {
+func (m *EmailClient) SendForgotPasswordEmail(to, token string) error {
 	from := "support@lenslocked.com"
 	subject := "Password reset request recieved for Lenslocked.com"
-	to := m.elisEmailAddress // todo only sends email to me because, well, its a free account
 	text := `
 	Hi There!
 
@@ -81,8 +100,101 @@ func (m *EmailClient) SendForgotPasswordEmail(token string) error {
 	resetURL := resetBaseURL + "?" + v.Encode()
 	resetText := fmt.Sprintf(text, resetURL, token)
 	resetHTML := fmt.Sprintf(resetHTMLTmpl, resetURL, resetURL, token)
-	message := mailgun.NewMessage(from, subject, resetText, to)
+	message := mailgun.NewMessage(from, subject, resetText, m.recipient(to))
 	message.SetHtml(resetHTML)
 	_, _, err := m.client.Send(message)
 	return err
 }
+
+const verifyHTMLTmpl = `Hi there!<br/>
+<br/>
+Please confirm this is your email address by following the link below<br/>
+<a href="%s">%s</a><br/>
+<br/>
+The link works for 48 hours. If you didn't sign up for Lenslocked you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
+
+const verifyBaseURL = "https://itah-lenslocked.herokuapp.com/verify"
+
+func (m *EmailClient) SendVerificationEmail(to, token string) error {
+	from := "support@lenslocked.com"
+	subject := "Please verify your email address for Lenslocked.com"
+	text := `
+	Hi There!
+
+	Please confirm this is your email address by following the link below
+
+	%s
+
+	The link works for 48 hours. If you didnt sign up for Lenslocked you can safely ignore this email.
+
+	Best,
+	Lenslocked Support`
+
+	v := url.Values{}
+	v.Set("token", token)
+	verifyURL := verifyBaseURL + "?" + v.Encode()
+	message := mailgun.NewMessage(from, subject, fmt.Sprintf(text, verifyURL), m.recipient(to))
+	message.SetHtml(fmt.Sprintf(verifyHTMLTmpl, verifyURL, verifyURL))
+	_, _, err := m.client.Send(message)
+	return err
+}
+
+const emailChangeHTMLTmpl = `Hi there!<br/>
+<br/>
+Someone asked to change the email address for their Lenslocked account to this one. If this was you, please follow the link below to confirm<br/>
+<a href="%s">%s</a><br/>
+<br/>
+The link works for 48 hours. If it wasn't you, you can safely ignore this email and nothing will change.<br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
+
+// SendEmailChangeEmail sends the link that confirms a new address to the
+// new address.
+func (m *EmailClient) SendEmailChangeEmail(to, token string) error {
+	from := "support@lenslocked.com"
+	subject := "Confirm your new email address for Lenslocked.com"
+	text := `
+	Hi There!
+
+	Someone asked to change the email address for their Lenslocked account to this one. If this was you, please follow the link below to confirm
+
+	%s
+
+	The link works for 48 hours. If it wasnt you, you can safely ignore this email and nothing will change.
+
+	Best,
+	Lenslocked Support`
+
+	v := url.Values{}
+	v.Set("token", token)
+	verifyURL := verifyBaseURL + "?" + v.Encode()
+	message := mailgun.NewMessage(from, subject, fmt.Sprintf(text, verifyURL), m.recipient(to))
+	message.SetHtml(fmt.Sprintf(emailChangeHTMLTmpl, verifyURL, verifyURL))
+	_, _, err := m.client.Send(message)
+	return err
+}
+
+// SendEmailChangeNoticeEmail lets the old address know about a change, in
+// case it wasn't them.
+func (m *EmailClient) SendEmailChangeNoticeEmail(to, newEmail string) error {
+	from := "support@lenslocked.com"
+	subject := "Your Lenslocked.com email address is being changed"
+	text := fmt.Sprintf(`
+	Hi There!
+
+	Someone asked to change the email address for your Lenslocked account to %s. It will change once they follow the link we sent there.
+
+	If this wasn't you, log in and change your password right away, then log out of any sessions you don't recognize from your account page.
+
+	Best,
+	Lenslocked Support`, newEmail)
+	msg := m.client.NewMessage(from, subject, text, m.recipient(to))
+	_, _, err := m.client.Send(msg)
+	return err
+}
@@ -0,0 +1,151 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+)
+
+const (
+	JobWelcomeEmail        = "email.welcome"
+	JobForgotPasswordEmail = "email.forgot_password"
+	JobVerificationEmail   = "email.verification"
+	JobEmailChangeEmail    = "email.email_change"
+	JobEmailChangeNotice   = "email.email_change_notice"
+)
+
+// Enqueuer saves a job for the background workers to pick up later.
+// models.JobService satisfies it.
+type Enqueuer interface {
+	Enqueue(kind string, payload interface{}) error
+}
+
+// NewQueue returns a Mailer that enqueues every email as a job instead of
+// making the request wait on mailgun. Deliver does the actual sending once
+// a worker picks the job up. Tokens in links are encrypted with cipher
+// before they go in the jobs table, so reading the table isn't enough to
+// reset someone's password.
+func NewQueue(client *EmailClient, jobs Enqueuer, cipher *hash.Cipher) *Queue {
+	return &Queue{
+		client: client,
+		jobs:   jobs,
+		cipher: cipher,
+	}
+}
+
+type Queue struct {
+	client *EmailClient
+	jobs   Enqueuer
+	cipher *hash.Cipher
+}
+
+var _ Mailer = &Queue{}
+
+type welcomePayload struct {
+	To string `json:"to"`
+}
+
+// forgotPasswordPayload's Token is encrypted with the queue's cipher.
+type forgotPasswordPayload struct {
+	To    string `json:"to"`
+	Token string `json:"token"`
+}
+
+// verificationPayload's Token is encrypted the same way.
+type verificationPayload struct {
+	To    string `json:"to"`
+	Token string `json:"token"`
+}
+
+type emailChangeNoticePayload struct {
+	To       string `json:"to"`
+	NewEmail string `json:"new_email"`
+}
+
+func (q *Queue) SendWelcomeEmail(to string) error {
+	return q.jobs.Enqueue(JobWelcomeEmail, welcomePayload{To: to})
+}
+
+func (q *Queue) SendForgotPasswordEmail(to, token string) error {
+	sealed, err := q.cipher.Encrypt(token)
+	if err != nil {
+		return err
+	}
+	return q.jobs.Enqueue(JobForgotPasswordEmail, forgotPasswordPayload{To: to, Token: sealed})
+}
+
+func (q *Queue) SendVerificationEmail(to, token string) error {
+	sealed, err := q.cipher.Encrypt(token)
+	if err != nil {
+		return err
+	}
+	return q.jobs.Enqueue(JobVerificationEmail, verificationPayload{To: to, Token: sealed})
+}
+
+func (q *Queue) SendEmailChangeEmail(to, token string) error {
+	sealed, err := q.cipher.Encrypt(token)
+	if err != nil {
+		return err
+	}
+	return q.jobs.Enqueue(JobEmailChangeEmail, verificationPayload{To: to, Token: sealed})
+}
+
+func (q *Queue) SendEmailChangeNoticeEmail(to, newEmail string) error {
+	return q.jobs.Enqueue(JobEmailChangeNotice, emailChangeNoticePayload{To: to, NewEmail: newEmail})
+}
+
+// Kinds lists every job kind Deliver knows how to send.
+func (q *Queue) Kinds() []string {
+	return []string{JobWelcomeEmail, JobForgotPasswordEmail, JobVerificationEmail, JobEmailChangeEmail, JobEmailChangeNotice}
+}
+
+// Deliver sends the email described by a queued job's kind and payload.
+func (q *Queue) Deliver(kind string, payload []byte) error {
+	switch kind {
+	case JobWelcomeEmail:
+		var p welcomePayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		return q.client.SendWelcomeEmail(p.To)
+	case JobForgotPasswordEmail:
+		var p forgotPasswordPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		token, err := q.cipher.Decrypt(p.Token)
+		if err != nil {
+			return err
+		}
+		return q.client.SendForgotPasswordEmail(p.To, token)
+	case JobVerificationEmail:
+		var p verificationPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		token, err := q.cipher.Decrypt(p.Token)
+		if err != nil {
+			return err
+		}
+		return q.client.SendVerificationEmail(p.To, token)
+	case JobEmailChangeEmail:
+		var p verificationPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		token, err := q.cipher.Decrypt(p.Token)
+		if err != nil {
+			return err
+		}
+		return q.client.SendEmailChangeEmail(p.To, token)
+	case JobEmailChangeNotice:
+		var p emailChangeNoticePayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		return q.client.SendEmailChangeNoticeEmail(p.To, p.NewEmail)
+	default:
+		return fmt.Errorf("email: unknown job kind %q", kind)
+	}
+}
@@ -0,0 +1,329 @@
+// Package exif reads the handful of EXIF tags we care about out of JPEGs
+// and can strip location or all metadata back out of them. It only knows
+// enough of the TIFF format to do that, it is not a general purpose parser.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNoExif is returned when the file simply doesn't have any EXIF data,
+// which is normal for screenshots, PNGs and anything that has been through
+// an image editor.
+var ErrNoExif = errors.New("exif: no exif data found")
+
+// Data is everything we pull out of a photo's EXIF block. Zero values
+// mean the camera didn't record that tag.
+type Data struct {
+	Make         string
+	Model        string
+	LensModel    string
+	ExposureTime string // eg "1/250"
+	FNumber      float64
+	ISO          int
+	FocalLength  float64 // in mm
+	TakenAt      time.Time
+	// Orientation is the EXIF orientation tag, 1 through 8. 1 is upright.
+	Orientation int
+	HasGPS      bool
+	Latitude    float64
+	Longitude   float64
+}
+
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829a
+	tagFNumber          = 0x829d
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920a
+	tagLensModel        = 0xa434
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// Decode reads the EXIF data out of a JPEG. Anything that isn't a JPEG or
+// has no EXIF block returns ErrNoExif.
+func Decode(r io.Reader) (*Data, error) {
+	seg, err := findExif(r)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTIFF(seg)
+	if err != nil {
+		return nil, err
+	}
+
+	d := Data{Orientation: 1}
+	ifd0, err := t.ifd(t.firstIFD())
+	if err != nil {
+		return nil, err
+	}
+	d.Make = t.str(ifd0[tagMake])
+	d.Model = t.str(ifd0[tagModel])
+	if e, ok := ifd0[tagOrientation]; ok {
+		if o := int(t.uint(e)); o >= 1 && o <= 8 {
+			d.Orientation = o
+		}
+	}
+	if e, ok := ifd0[tagDateTime]; ok {
+		d.TakenAt = parseTime(t.str(e))
+	}
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		sub, err := t.ifd(t.uint(e))
+		if err == nil {
+			if e, ok := sub[tagExposureTime]; ok {
+				num, den := t.rational(e, 0)
+				d.ExposureTime = formatExposure(num, den)
+			}
+			if e, ok := sub[tagFNumber]; ok {
+				d.FNumber = t.float(e, 0)
+			}
+			if e, ok := sub[tagISO]; ok {
+				d.ISO = int(t.uint(e))
+			}
+			if e, ok := sub[tagFocalLength]; ok {
+				d.FocalLength = t.float(e, 0)
+			}
+			if e, ok := sub[tagDateTimeOriginal]; ok {
+				if taken := parseTime(t.str(e)); !taken.IsZero() {
+					d.TakenAt = taken
+				}
+			}
+			d.LensModel = t.str(sub[tagLensModel])
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		gps, err := t.ifd(t.uint(e))
+		if err == nil {
+			lat, latOK := gps[tagGPSLatitude]
+			lon, lonOK := gps[tagGPSLongitude]
+			if latOK && lonOK && lat.count >= 3 && lon.count >= 3 {
+				d.HasGPS = true
+				d.Latitude = t.degrees(lat, t.str(gps[tagGPSLatitudeRef]))
+				d.Longitude = t.degrees(lon, t.str(gps[tagGPSLongitudeRef]))
+			}
+		}
+	}
+	return &d, nil
+}
+
+// findExif walks the JPEG's segments looking for the APP1 block that holds
+// the EXIF data and returns the TIFF structure inside it.
+func findExif(r io.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, ErrNoExif
+	}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, ErrNoExif
+		}
+		if hdr[0] != 0xff {
+			return nil, ErrNoExif
+		}
+		marker := hdr[1]
+		// start of scan means the image data has begun, metadata always comes first
+		if marker == 0xda || marker == 0xd9 {
+			return nil, ErrNoExif
+		}
+		length := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if length < 0 {
+			return nil, ErrNoExif
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, ErrNoExif
+		}
+		if marker == 0xe1 && bytes.HasPrefix(body, exifHeader) {
+			return body[len(exifHeader):], nil
+		}
+	}
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// tiff is the structure inside an EXIF block, a byte order marker followed
+// by a chain of IFDs (image file directories) full of tag entries.
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+type entry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	offset int // where the entry itself starts
+	data   []byte
+	// dataOffset is where data lives in the tiff, it points inside the
+	// entry when the value was small enough to be stored inline.
+	dataOffset int
+}
+
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func newTIFF(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, ErrNoExif
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrNoExif
+	}
+	if t.order.Uint16(b[2:]) != 42 {
+		return nil, ErrNoExif
+	}
+	return &t, nil
+}
+
+func (t *tiff) firstIFD() uint32 {
+	return t.order.Uint32(t.b[4:])
+}
+
+// ifd reads the directory at offset into a map of its entries by tag.
+func (t *tiff) ifd(offset uint32) (map[uint16]entry, error) {
+	entries, err := t.entries(offset)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[uint16]entry, len(entries))
+	for _, e := range entries {
+		m[e.tag] = e
+	}
+	return m, nil
+}
+
+func (t *tiff) entries(offset uint32) ([]entry, error) {
+	off := int(offset)
+	if off < 8 || off+2 > len(t.b) {
+		return nil, fmt.Errorf("exif: ifd offset %d out of range", offset)
+	}
+	n := int(t.order.Uint16(t.b[off:]))
+	off += 2
+	if off+n*12 > len(t.b) {
+		return nil, fmt.Errorf("exif: ifd at %d is truncated", offset)
+	}
+
+	entries := make([]entry, 0, n)
+	for i := 0; i < n; i++ {
+		p := off + i*12
+		e := entry{
+			tag:    t.order.Uint16(t.b[p:]),
+			typ:    t.order.Uint16(t.b[p+2:]),
+			count:  t.order.Uint32(t.b[p+4:]),
+			offset: p,
+		}
+		size, ok := typeSizes[e.typ]
+		if !ok {
+			continue
+		}
+		total := size * int(e.count)
+		if total < 0 || e.count > uint32(len(t.b)) {
+			continue
+		}
+		if total <= 4 {
+			e.dataOffset = p + 8
+		} else {
+			e.dataOffset = int(t.order.Uint32(t.b[p+8:]))
+		}
+		if e.dataOffset+total > len(t.b) {
+			continue
+		}
+		e.data = t.b[e.dataOffset : e.dataOffset+total]
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (t *tiff) str(e entry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+func (t *tiff) uint(e entry) uint32 {
+	switch e.typ {
+	case 3:
+		if len(e.data) >= 2 {
+			return uint32(t.order.Uint16(e.data))
+		}
+	case 4, 9:
+		if len(e.data) >= 4 {
+			return t.order.Uint32(e.data)
+		}
+	case 1, 7:
+		if len(e.data) >= 1 {
+			return uint32(e.data[0])
+		}
+	}
+	return 0
+}
+
+func (t *tiff) rational(e entry, i int) (uint32, uint32) {
+	if (e.typ != 5 && e.typ != 10) || len(e.data) < (i+1)*8 {
+		return 0, 0
+	}
+	return t.order.Uint32(e.data[i*8:]), t.order.Uint32(e.data[i*8+4:])
+}
+
+func (t *tiff) float(e entry, i int) float64 {
+	num, den := t.rational(e, i)
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// degrees turns the degrees, minutes, seconds rationals GPS uses into
+// a signed decimal, negative for south and west.
+func (t *tiff) degrees(e entry, ref string) float64 {
+	d := t.float(e, 0) + t.float(e, 1)/60 + t.float(e, 2)/3600
+	if ref == "S" || ref == "W" {
+		d = -d
+	}
+	return d
+}
+
+func parseTime(s string) time.Time {
+	taken, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil {
+		return time.Time{}
+	}
+	return taken
+}
+
+// formatExposure shows exposure the way photographers write it, 1/250 for
+// fast shutters and 2.5 for long ones.
+func formatExposure(num, den uint32) string {
+	if num == 0 || den == 0 {
+		return ""
+	}
+	if num >= den {
+		v := float64(num) / float64(den)
+		return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.1f", v), "0"), ".")
+	}
+	return fmt.Sprintf("1/%d", (den+num/2)/num)
+}
@@ -0,0 +1,54 @@
+package exif
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Orient returns img turned the right way up according to an EXIF
+// orientation tag. Cameras save every photo in the sensor's orientation
+// and just note which way round it was held.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	src := image.NewRGBA(img.Bounds())
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if Rotated(orientation) {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				dx, dy = x, h-1-y
+			case 5: // mirrored and rotated 90 ccw
+				dx, dy = y, x
+			case 6: // rotated 90 ccw, so turn it 90 cw
+				dx, dy = h-1-y, x
+			case 7: // mirrored and rotated 90 cw
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 cw, so turn it 90 ccw
+				dx, dy = y, w-1-x
+			}
+			dst.SetRGBA(dx, dy, src.RGBAAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// Rotated is true for orientations where the stored width and height are
+// swapped compared to how the photo should be shown.
+func Rotated(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
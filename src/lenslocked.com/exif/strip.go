@@ -0,0 +1,144 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrNotJPEG is returned when asked to strip metadata from anything else.
+var ErrNotJPEG = errors.New("exif: not a jpeg")
+
+// ErrGPSUnreadable is returned by StripGPS when an EXIF block is too broken
+// to find the GPS tags in, so there's no telling whether they're gone.
+var ErrGPSUnreadable = errors.New("exif: gps tags can't be read to remove them")
+
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// StripGPS returns a copy of the jpeg with its GPS tags wiped, both the
+// EXIF ones and any XMP block (which can hold location too). Everything
+// else, including the orientation tag, is left alone. If an EXIF block
+// can't be read well enough to wipe it ErrGPSUnreadable is returned, and
+// StripAll is the only safe option left.
+func StripGPS(jpeg []byte) ([]byte, error) {
+	var wipeErr error
+	out, err := rewriteSegments(jpeg, func(marker byte, body []byte) ([]byte, bool) {
+		if marker != 0xe1 {
+			return body, true
+		}
+		if bytes.HasPrefix(body, xmpHeader) {
+			return nil, false
+		}
+		if bytes.HasPrefix(body, exifHeader) {
+			cleaned := append([]byte(nil), body...)
+			if err := wipeGPS(cleaned[len(exifHeader):]); err != nil {
+				wipeErr = err
+				return nil, false
+			}
+			return cleaned, true
+		}
+		return body, true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if wipeErr != nil {
+		return nil, wipeErr
+	}
+	return out, nil
+}
+
+// StripAll returns a copy of the jpeg without any EXIF, XMP, IPTC or
+// comment blocks. Color profiles are kept since dropping them changes how
+// the photo looks. Note this drops the orientation tag too, so sideways
+// photos should be rotated before they are stripped.
+func StripAll(jpeg []byte) ([]byte, error) {
+	return rewriteSegments(jpeg, func(marker byte, body []byte) ([]byte, bool) {
+		switch marker {
+		case 0xe1, 0xed, 0xfe: // APP1 (exif, xmp), APP13 (iptc), COM
+			return nil, false
+		}
+		return body, true
+	})
+}
+
+// rewriteSegments copies a jpeg segment by segment, letting fn replace or
+// drop each metadata segment. Everything from the start of scan on is the
+// image itself and is copied as is.
+func rewriteSegments(b []byte, fn func(marker byte, body []byte) ([]byte, bool)) ([]byte, error) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil, ErrNotJPEG
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(b)))
+	out.Write(b[:2])
+	p := 2
+	for {
+		// markers can be padded with any number of 0xff bytes
+		for p+1 < len(b) && b[p] == 0xff && b[p+1] == 0xff {
+			p++
+		}
+		if p+4 > len(b) || b[p] != 0xff {
+			return nil, ErrNotJPEG
+		}
+		marker := b[p+1]
+		if marker == 0xda || marker == 0xd9 {
+			out.Write(b[p:])
+			return out.Bytes(), nil
+		}
+		length := int(binary.BigEndian.Uint16(b[p+2:]))
+		if length < 2 || p+2+length > len(b) {
+			return nil, ErrNotJPEG
+		}
+		body, keep := fn(marker, b[p+4:p+2+length])
+		if keep {
+			if len(body)+2 > 0xffff {
+				return nil, ErrNotJPEG
+			}
+			var hdr [4]byte
+			hdr[0], hdr[1] = 0xff, marker
+			binary.BigEndian.PutUint16(hdr[2:], uint16(len(body)+2))
+			out.Write(hdr[:])
+			out.Write(body)
+		}
+		p += 2 + length
+	}
+}
+
+// wipeGPS zeroes every GPS entry and the values they point at in place,
+// leaving an empty GPS directory behind. Rewriting in place keeps every
+// other offset in the block valid. It returns ErrGPSUnreadable unless it
+// is sure there's no GPS left, in which case the block has to go.
+func wipeGPS(b []byte) error {
+	t, err := newTIFF(b)
+	if err != nil {
+		return ErrGPSUnreadable
+	}
+	ifd0, err := t.ifd(t.firstIFD())
+	if err != nil {
+		return ErrGPSUnreadable
+	}
+	e, ok := ifd0[tagGPSIFD]
+	if !ok {
+		return nil
+	}
+	gpsOffset := t.uint(e)
+	entries, err := t.entries(gpsOffset)
+	if err != nil {
+		return ErrGPSUnreadable
+	}
+	// entries skips ones it can't make sense of, whose values would be
+	// left behind
+	if len(entries) != int(t.order.Uint16(b[gpsOffset:])) {
+		return ErrGPSUnreadable
+	}
+	for _, e := range entries {
+		for i := range e.data {
+			e.data[i] = 0
+		}
+		for i := e.offset; i < e.offset+12; i++ {
+			b[i] = 0
+		}
+	}
+	t.order.PutUint16(b[gpsOffset:], 0)
+	return nil
+}
@@ -0,0 +1,112 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrNotWebP is returned when asked to strip metadata from a webp that
+// isn't one, or is cut off part way through a chunk.
+var ErrNotWebP = errors.New("exif: not a webp")
+
+const (
+	// the bits in a VP8X chunk's flags saying EXIF and XMP chunks follow
+	vp8xFlagEXIF = 0x08
+	vp8xFlagXMP  = 0x04
+)
+
+// StripGPSWebP is StripGPS for webps. Their EXIF lives in an EXIF chunk,
+// which gets the same treatment as a jpeg's, and any XMP chunk is dropped.
+// The pixels are never touched so there's nothing to re-encode. An EXIF
+// chunk that can't be wiped is dropped, browsers ignore webp orientation
+// tags so nothing is lost.
+func StripGPSWebP(webp []byte) ([]byte, error) {
+	return rewriteChunks(webp, func(id string, body []byte) ([]byte, bool) {
+		switch id {
+		case "XMP ":
+			return nil, false
+		case "EXIF":
+			cleaned := append([]byte(nil), body...)
+			// some writers keep the jpeg style header in front of the tiff
+			if err := wipeGPS(bytes.TrimPrefix(cleaned, exifHeader)); err != nil {
+				return nil, false
+			}
+			return cleaned, true
+		}
+		return body, true
+	})
+}
+
+// StripAllWebP is StripAll for webps, dropping the EXIF and XMP chunks.
+// Color profiles are kept for the same reason.
+func StripAllWebP(webp []byte) ([]byte, error) {
+	return rewriteChunks(webp, func(id string, body []byte) ([]byte, bool) {
+		switch id {
+		case "EXIF", "XMP ":
+			return nil, false
+		}
+		return body, true
+	})
+}
+
+// rewriteChunks copies a webp chunk by chunk, letting fn replace or drop
+// each one. Afterwards the VP8X flags are fixed up to match the metadata
+// chunks that are left and the RIFF header gets the new size.
+func rewriteChunks(b []byte, fn func(id string, body []byte) ([]byte, bool)) ([]byte, error) {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return nil, ErrNotWebP
+	}
+	end := 8 + int(binary.LittleEndian.Uint32(b[4:]))
+	if end > len(b) {
+		return nil, ErrNotWebP
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(b)))
+	out.Write(b[:12])
+	vp8x := -1
+	var hasEXIF, hasXMP bool
+	for p := 12; p < end; {
+		if p+8 > end {
+			return nil, ErrNotWebP
+		}
+		id := string(b[p : p+4])
+		size := int(binary.LittleEndian.Uint32(b[p+4:]))
+		if size < 0 || p+8+size > end {
+			return nil, ErrNotWebP
+		}
+		body, keep := fn(id, b[p+8:p+8+size])
+		// chunks are padded to an even length
+		p += 8 + size + size&1
+		if !keep {
+			continue
+		}
+		switch id {
+		case "VP8X":
+			vp8x = out.Len() + 8
+		case "EXIF":
+			hasEXIF = true
+		case "XMP ":
+			hasXMP = true
+		}
+		var hdr [8]byte
+		copy(hdr[:4], id)
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(len(body)))
+		out.Write(hdr[:])
+		out.Write(body)
+		if len(body)&1 == 1 {
+			out.WriteByte(0)
+		}
+	}
+
+	webp := out.Bytes()
+	if vp8x >= 0 && vp8x < len(webp) {
+		if !hasEXIF {
+			webp[vp8x] &^= vp8xFlagEXIF
+		}
+		if !hasXMP {
+			webp[vp8x] &^= vp8xFlagXMP
+		}
+	}
+	binary.LittleEndian.PutUint32(webp[4:], uint32(len(webp)-8))
+	return webp, nil
+}
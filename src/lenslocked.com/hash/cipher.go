@@ -0,0 +1,62 @@
+package hash
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
+)
+
+// ErrCiphertextInvalid is returned when decrypting something that wasn't
+// encrypted with this key, or has been tampered with.
+var ErrCiphertextInvalid = errors.New("hash: ciphertext is invalid")
+
+// Cipher encrypts small secrets we need to get back later, unlike passwords
+// and tokens which only ever need comparing against a hash. It is AES-256
+// GCM so anything tampered with fails to decrypt rather than decrypting to
+// garbage.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher makes a Cipher keyed with the SHA-256 of key, so any length of
+// key works.
+func NewCipher(key string) (*Cipher, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns plaintext encrypted with a fresh nonce, base64 encoded so
+// it can go straight in a text column.
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	nonce, err := rand.Bytes(c.aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+func (c *Cipher) Decrypt(ciphertext string) (string, error) {
+	sealed, err := base64.URLEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", ErrCiphertextInvalid
+	}
+	n := c.aead.NonceSize()
+	plaintext, err := c.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", ErrCiphertextInvalid
+	}
+	return string(plaintext), nil
+}
@@ -4,25 +4,25 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
 // NewHMAC creates and returns an HMAC object
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
 	return HMAC{
-		hmac: h,
+		key: []byte(key),
 	}
 }
 
-// HMAC is a wrapper around the crypto/hmac package making it easier to use
+// HMAC is a wrapper around the crypto/hmac package making it easier to use.
+// A fresh hash is made for every call since a hash.Hash can't be shared
+// between requests running at the same time.
 type HMAC struct {
-	hmac hash.Hash
+	key []byte
 }
 
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(b)
 }
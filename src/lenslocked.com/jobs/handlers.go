@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/email"
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+)
+
+// ImageVariants builds the resized copies of a freshly uploaded image.
+func ImageVariants(is models.ImageService) Handler {
+	return func(job *models.Job) error {
+		var p models.ImageJob
+		if err := job.Decode(&p); err != nil {
+			return err
+		}
+		image, err := is.ByID(p.ImageID)
+		if err == models.ErrNotFound {
+			// deleted before we got to it, nothing left to do
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return is.GenerateVariants(image)
+	}
+}
+
+// Email sends any of the emails queued up by email.Queue.
+func Email(q *email.Queue) Handler {
+	return func(job *models.Job) error {
+		return q.Deliver(job.Kind, []byte(job.Payload))
+	}
+}
+
+// UploadCleanup throws away resumable uploads that were abandoned part way,
+// it's meant to be run with Worker.Every.
+func UploadCleanup(us models.UploadSessionService) func() error {
+	return func() error {
+		n, err := us.Cleanup()
+		if n > 0 {
+			fmt.Printf("Cleaned up %d abandoned uploads\n", n)
+		}
+		return err
+	}
+}
+
+// SessionCleanup deletes sessions that have expired, it's meant to be run
+// with Worker.Every.
+func SessionCleanup(ss models.SessionService) func() error {
+	return func() error {
+		n, err := ss.Cleanup()
+		if n > 0 {
+			fmt.Printf("Cleaned up %d expired sessions\n", n)
+		}
+		return err
+	}
+}
+
+// TrashPurge deletes galleries and photos for good once they've been in the
+// trash longer than retention, it's meant to be run with Worker.Every.
+func TrashPurge(gs models.GalleryService, is models.ImageService, retention time.Duration) func() error {
+	return func() error {
+		before := time.Now().Add(-retention)
+		// galleries first, their images go with them
+		galleries, gErr := gs.PurgeTrash(before)
+		images, iErr := is.PurgeTrash(before)
+		if galleries > 0 || images > 0 {
+			fmt.Printf("Purged %d galleries and %d photos from the trash\n", galleries, images)
+		}
+		if gErr != nil {
+			return gErr
+		}
+		return iErr
+	}
+}
@@ -0,0 +1,160 @@
+package jobs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/models"
+)
+
+// Handler does the work for one kind of job. Returning an error fails the
+// job so it gets retried later.
+type Handler func(job *models.Job) error
+
+// NewWorker returns a Worker that runs n jobs at a time out of js.
+func NewWorker(js models.JobService, n int) *Worker {
+	if n < 1 {
+		n = 1
+	}
+	return &Worker{
+		js:       js,
+		handlers: make(map[string]Handler),
+		n:        n,
+		poll:     2 * time.Second,
+		quit:     make(chan struct{}),
+	}
+}
+
+// Worker polls the jobs table from a handful of goroutines and hands each
+// job to the Handler registered for its kind.
+type Worker struct {
+	js       models.JobService
+	handlers map[string]Handler
+	periodic []periodic
+	n        int
+	poll     time.Duration
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Handle registers h to run jobs of the given kind. It must be called
+// before Start.
+func (w *Worker) Handle(kind string, h Handler) {
+	w.handlers[kind] = h
+}
+
+// periodic is housekeeping registered with Every.
+type periodic struct {
+	name     string
+	interval time.Duration
+	fn       func() error
+}
+
+// Every runs fn every interval for as long as the worker is running, for
+// housekeeping like clearing out abandoned uploads. The first run is one
+// interval after Start. It must be called before Start.
+func (w *Worker) Every(interval time.Duration, name string, fn func() error) {
+	w.periodic = append(w.periodic, periodic{name: name, interval: interval, fn: fn})
+}
+
+// Start kicks off the worker goroutines and returns right away.
+func (w *Worker) Start() {
+	for i := 0; i < w.n; i++ {
+		w.wg.Add(1)
+		go w.loop()
+	}
+	for _, p := range w.periodic {
+		w.wg.Add(1)
+		go w.tick(p)
+	}
+}
+
+// Stop tells the workers to quit and waits for whatever they are in the
+// middle of to finish.
+func (w *Worker) Stop() {
+	close(w.quit)
+	w.wg.Wait()
+}
+
+func (w *Worker) loop() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.quit:
+			return
+		default:
+		}
+
+		job, err := w.js.Next()
+		if err != nil {
+			if err != models.ErrNotFound {
+				fmt.Printf("Error fetching next job: %s\n", err)
+			}
+			// nothing to do (or the db is having a moment), wait a bit
+			select {
+			case <-w.quit:
+				return
+			case <-time.After(w.poll):
+			}
+			continue
+		}
+		w.run(job)
+	}
+}
+
+func (w *Worker) tick(p periodic) {
+	defer w.wg.Done()
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-t.C:
+		}
+		if err := p.run(); err != nil {
+			fmt.Printf("Periodic %s failed: %s\n", p.name, err)
+		}
+	}
+}
+
+// run is fn with a panic turned into an error, same as handle.
+func (p periodic) run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("jobs: %s panicked: %v", p.name, r)
+		}
+	}()
+	return p.fn()
+}
+
+func (w *Worker) run(job *models.Job) {
+	err := w.handle(job)
+	if err == nil {
+		if err := w.js.Complete(job); err != nil {
+			fmt.Printf("Error completing job %d: %s\n", job.ID, err)
+		}
+		return
+	}
+
+	fmt.Printf("Job %d (%s) failed on attempt %d: %s\n", job.ID, job.Kind, job.Attempts, err)
+	if err := w.js.Fail(job, err); err != nil {
+		fmt.Printf("Error failing job %d: %s\n", job.ID, err)
+	}
+}
+
+// handle runs the job's handler, turning a panic into a plain old error so
+// one bad job can't take the whole server down with it.
+func (w *Worker) handle(job *models.Job) (err error) {
+	h, ok := w.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("jobs: no handler registered for %q", job.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("jobs: handler panicked: %v", r)
+		}
+	}()
+	return h(job)
+}
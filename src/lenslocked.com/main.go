@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/eitah/lenslocked/src/lenslocked.com/controllers"
 	"github.com/eitah/lenslocked/src/lenslocked.com/email"
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/jobs"
 	"github.com/eitah/lenslocked/src/lenslocked.com/middleware"
 	"github.com/eitah/lenslocked/src/lenslocked.com/models"
 	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
@@ -21,6 +29,17 @@ var (
 	fourOhFourView *views.View
 )
 
+// noDirListing stops a FileServer from listing what is in a directory.
+func noDirListing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") || r.URL.Path == "" {
+			fourOhFour(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func fourOhFour(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -29,16 +48,32 @@ func fourOhFour(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	boolPtr := flag.Bool("prod", false, "Provide this flag in production. This ensures that a .config file is provided before the app starts.")
+	backfillImages := flag.Bool("backfill-images", false, "Import image files already on disk into the images table, then exit.")
+	reconcileImages := flag.Bool("reconcile-images", false, "Delete image files in storage that no gallery or image points at any more, then exit.")
+	dryRun := flag.Bool("dry-run", false, "With -reconcile-images, only list the files that would be deleted.")
 	flag.Parse()
 	config := NewConfig(*boolPtr)
 	mgCfg := config.Mailgun
 	emailClient := email.NewEmailClient(mgCfg.Domain, mgCfg.APIKey, mgCfg.PublicAPIKey, mgCfg.ElisEmailAddress)
+	store, err := config.Storage.Store()
+	if err != nil {
+		panic(err)
+	}
+	signer, err := config.URLSigner()
+	if err != nil {
+		panic(err)
+	}
 	services, err := models.NewServices(
 		models.WithGorm(config.Database.Dialect(), config.Database.ConnectionInfo()),
 		models.WithLogMode(!config.IsProd()),
-		models.WithUser(config.Pepper, config.HMACKey),
-		models.WithGallery(),
-		models.WithImage(),
+		models.WithUser(config.Pepper, config.HMACKey, config.TwoFactorKey()),
+		models.WithSession(config.HMACKey),
+		models.WithUsage(config.Quota.Quota()),
+		models.WithGallery(config.Pepper, config.HMACKey),
+		models.WithJob(),
+		models.WithImage(store, signer),
+		models.WithShareLink(config.HMACKey),
+		models.WithUpload(store),
 	)
 	if err != nil {
 		panic(err)
@@ -47,16 +82,70 @@ func main() {
 	defer services.Close()
 	services.AutoMigrate()
 
+	if *backfillImages {
+		n, err := services.Image.Backfill()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Backfilled %d images\n", n)
+		return
+	}
+
+	if *reconcileImages {
+		orphans, err := services.Image.Reconcile(*dryRun)
+		for _, key := range orphans {
+			fmt.Println(key)
+		}
+		if err != nil {
+			panic(err)
+		}
+		if *dryRun {
+			fmt.Printf("Found %d orphaned files, run without -dry-run to delete them\n", len(orphans))
+		} else {
+			fmt.Printf("Deleted %d orphaned files and directories\n", len(orphans))
+		}
+		return
+	}
+
+	// Emails and image processing happen in the background so requests
+	// don't have to wait on mailgun or resizing huge jpegs.
+	emailCipher, err := hash.NewCipher(config.EmailJobKey())
+	if err != nil {
+		panic(err)
+	}
+	mailer := email.NewQueue(&emailClient, services.Job, emailCipher)
+	worker := jobs.NewWorker(services.Job, 2)
+	worker.Handle(models.JobImageVariants, jobs.ImageVariants(services.Image))
+	for _, kind := range mailer.Kinds() {
+		worker.Handle(kind, jobs.Email(mailer))
+	}
+	worker.Every(time.Hour, "upload cleanup", jobs.UploadCleanup(services.Upload))
+	worker.Every(time.Hour, "session cleanup", jobs.SessionCleanup(services.Session))
+	if retention := config.TrashRetention(); retention > 0 {
+		worker.Every(time.Hour, "trash purge", jobs.TrashPurge(services.Gallery, services.Image, retention))
+	}
+
 	r := mux.NewRouter()
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User, emailClient, r)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r)
+	usersC := controllers.NewUsers(services.User, services.Session, mailer, r)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.ShareLink, services.Upload, services.Usage, config.TrashRetention(), r)
+	imagesC := controllers.NewImages(services.Gallery, services.Image, services.ShareLink, signer)
 	fourOhFourView = views.NewView("bootstrap", "fourohfour")
 
+	proxies, err := config.Proxies()
+	if err != nil {
+		panic(err)
+	}
 	userMW := &middleware.User{
-		UserService: services.User,
+		UserService:    services.User,
+		SessionService: services.Session,
+		TrustedProxies: proxies,
 	}
 	requireUserMW := &middleware.RequireUser{}
+	// unverified users can log in but can't do these until they verify
+	verifiedUploadsMW := &middleware.RequireVerified{Enabled: config.Unverified.BlockUploads, Action: "uploading photos"}
+	verifiedGalleriesMW := &middleware.RequireVerified{Enabled: config.Unverified.BlockGalleries, Action: "creating galleries"}
+	verifiedSharingMW := &middleware.RequireVerified{Enabled: config.Unverified.BlockSharing, Action: "sharing galleries"}
 
 	// Handle lets you just get a view
 	r.Handle("/", staticC.Home).Methods("GET")
@@ -70,31 +159,67 @@ func main() {
 	r.HandleFunc("/signup", usersC.New).Methods("GET")
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.HandleFunc("/login/2fa", usersC.TwoFactorLogin).Methods("GET").Name(controllers.TwoFactorLogin)
+	r.HandleFunc("/login/2fa", usersC.CompleteTwoFactorLogin).Methods("POST")
 	r.HandleFunc("/forgot", usersC.Forgot).Methods("GET")
 	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
 	r.HandleFunc("/reset", usersC.Reset).Methods("GET")
 	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
+	r.HandleFunc("/verify", usersC.Verify).Methods("GET")
+	r.HandleFunc("/verify/resend", requireUserMW.ApplyFn(usersC.ResendVerification)).Methods("POST")
 	r.HandleFunc("/logout", requireUserMW.ApplyFn(usersC.Logout)).Methods("POST")
+	r.HandleFunc("/account", requireUserMW.ApplyFn(usersC.Account)).Methods("GET").Name(controllers.Account)
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/revoke", requireUserMW.ApplyFn(usersC.RevokeSession)).Methods("POST")
+	r.HandleFunc("/account/sessions/revoke-others", requireUserMW.ApplyFn(usersC.RevokeOtherSessions)).Methods("POST")
+	r.HandleFunc("/account/settings", requireUserMW.ApplyFn(usersC.Settings)).Methods("GET").Name(controllers.AccountSettings)
+	r.HandleFunc("/account/settings/name", requireUserMW.ApplyFn(usersC.UpdateName)).Methods("POST")
+	r.HandleFunc("/account/settings/email", requireUserMW.ApplyFn(usersC.ChangeEmail)).Methods("POST")
+	r.HandleFunc("/account/settings/password", requireUserMW.ApplyFn(usersC.ChangePassword)).Methods("POST")
+	r.HandleFunc("/account/2fa", requireUserMW.ApplyFn(usersC.TwoFactor)).Methods("GET").Name(controllers.TwoFactor)
+	r.HandleFunc("/account/2fa/enable", requireUserMW.ApplyFn(usersC.EnableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/2fa/disable", requireUserMW.ApplyFn(usersC.DisableTwoFactor)).Methods("POST")
 	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
 
-	r.Handle("/galleries/new", requireUserMW.Apply(galleriesC.NewView)).Methods("GET")
-	r.HandleFunc("/galleries", requireUserMW.ApplyFn(galleriesC.Create)).Methods("POST")
+	r.Handle("/galleries/new", requireUserMW.ApplyFn(verifiedGalleriesMW.Apply(galleriesC.NewView))).Methods("GET")
+	r.HandleFunc("/galleries", requireUserMW.ApplyFn(verifiedGalleriesMW.ApplyFn(galleriesC.Create))).Methods("POST")
 	r.HandleFunc("/galleries/show/{id:[0-9]+}", galleriesC.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/show/{id:[0-9]+}/download", galleriesC.Download).Methods("GET")
+	r.HandleFunc("/g/{token}", galleriesC.ShowUnlisted).Methods("GET").Name(controllers.UnlistedGallery)
+	r.HandleFunc("/g/{token}/download", galleriesC.DownloadUnlisted).Methods("GET")
+	r.HandleFunc("/s/{token}", galleriesC.ShareShow).Methods("GET")
+	r.HandleFunc("/s/{token}/download", galleriesC.DownloadShared).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/unlock", galleriesC.Unlock).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares", requireUserMW.ApplyFn(verifiedSharingMW.ApplyFn(galleriesC.ShareCreate))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares/{share_id:[0-9]+}/revoke", requireUserMW.ApplyFn(galleriesC.ShareRevoke)).Methods("POST")
 	r.HandleFunc("/galleries", requireUserMW.ApplyFn(galleriesC.Index)).Methods("GET").Name(controllers.IndexGalleries)
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMW.ApplyFn(galleriesC.Edit)).Methods("GET").Name(controllers.EditGallery)
 	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMW.ApplyFn(galleriesC.Update)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMW.ApplyFn(galleriesC.Delete)).Methods("POST")
+	r.HandleFunc("/trash", requireUserMW.ApplyFn(galleriesC.Trash)).Methods("GET").Name(controllers.TrashIndex)
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/restore", requireUserMW.ApplyFn(galleriesC.TrashRestoreGallery)).Methods("POST")
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/purge", requireUserMW.ApplyFn(galleriesC.TrashPurgeGallery)).Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/restore", requireUserMW.ApplyFn(galleriesC.TrashRestoreImage)).Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/purge", requireUserMW.ApplyFn(galleriesC.TrashPurgeImage)).Methods("POST")
 
-	// <form action="/galleries/{{.GalleryID}}/images/{{.Filename}}/delete" method="POST">
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMW.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMW.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
+	// <form action="/galleries/{{.GalleryID}}/images/{{.StorageName}}/delete" method="POST">
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{name}/delete", requireUserMW.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{name}/update", requireUserMW.ApplyFn(galleriesC.ImageUpdate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{name}/cover", requireUserMW.ApplyFn(galleriesC.ImageCover)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order", requireUserMW.ApplyFn(galleriesC.ImageOrder)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMW.ApplyFn(verifiedUploadsMW.ApplyFn(galleriesC.ImageUpload))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/import", requireUserMW.ApplyFn(verifiedUploadsMW.ApplyFn(galleriesC.ImageImport))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", requireUserMW.ApplyFn(verifiedUploadsMW.ApplyFn(galleriesC.UploadStart))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id:[0-9]+}", requireUserMW.ApplyFn(galleriesC.UploadStatus)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id:[0-9]+}", requireUserMW.ApplyFn(galleriesC.UploadAppend)).Methods("PUT")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id:[0-9]+}", requireUserMW.ApplyFn(galleriesC.UploadCancel)).Methods("DELETE")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id:[0-9]+}/finish", requireUserMW.ApplyFn(galleriesC.UploadFinish)).Methods("POST")
 
-	// http.Dir matches the path exactly with how it fetches the static file, so we use stripPrefix to help match the path.
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	// Images are served from whichever store they are in, once we have
+	// checked the gallery they belong to can be seen.
+	r.PathPrefix("/images/galleries/{id:[0-9]+}/").HandlerFunc(imagesC.Serve).Methods("GET", "HEAD")
 
 	// Assets
-	assetHandler := http.FileServer(http.Dir("./assets/"))
+	assetHandler := noDirListing(http.FileServer(http.Dir("./assets/")))
 	assetHandler = http.StripPrefix("/assets/", assetHandler)
 	r.PathPrefix("/assets/").Handler(assetHandler)
 
@@ -109,6 +234,28 @@ func main() {
 	// although forbidden to do this, unless server restarts
 	// this would reset, so this could be a static token instead
 	csrfMW := csrf.Protect(randString, csrf.Secure(config.IsProd()))
-	port := fmt.Sprintf(":%d", config.Port)
-	http.ListenAndServe(port, csrfMW(userMW.Apply(r)))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: csrfMW(userMW.Apply(r)),
+	}
+
+	worker.Start()
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	// heroku sends a SIGTERM on every deploy, so give in flight requests and
+	// jobs a chance to wrap up before we exit.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("Error shutting down server: %s\n", err)
+	}
+	worker.Stop()
 }
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/context"
+	"github.com/eitah/lenslocked/src/lenslocked.com/views"
+)
+
+// RequireVerified stops users who haven't verified their email address
+// from doing whatever it wraps, if Enabled. It goes inside RequireUser.
+type RequireVerified struct {
+	Enabled bool
+	// Action finishes "Please verify your email address before ...",
+	// eg "uploading photos".
+	Action string
+}
+
+func (mw *RequireVerified) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireVerified) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	if !mw.Enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil || user.EmailVerified() {
+			next(w, r)
+			return
+		}
+		msg := fmt.Sprintf("Please verify your email address before %s. Check your inbox for the link we sent to %s.", mw.Action, user.Email)
+		if !isFormRequest(r) {
+			// the chunked upload api, which wants its errors as json
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
+		views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: msg,
+		})
+	})
+}
+
+// isFormRequest is true for pages and form posts, as opposed to api calls.
+func isFormRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return true
+	}
+	ct := r.Header.Get("Content-Type")
+	return strings.HasPrefix(ct, "application/x-www-form-urlencoded") ||
+		strings.HasPrefix(ct, "multipart/form-data")
+}
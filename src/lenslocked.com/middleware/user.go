@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
@@ -8,8 +10,14 @@ import (
 	"github.com/eitah/lenslocked/src/lenslocked.com/models"
 )
 
+// User finds who is logged in from their session cookie and puts them, and
+// the session, on the request context.
 type User struct {
 	models.UserService
+	SessionService models.SessionService
+	// TrustedProxies are the networks of the proxies in front of the app,
+	// only they get to tell us who the client is with X-Forwarded-For.
+	TrustedProxies []*net.IPNet
 }
 
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
@@ -19,29 +27,88 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/assets/") ||
-			strings.HasPrefix(path, "/images/") {
-			// static asset and images dont need a user token from db so bypass
+		if strings.HasPrefix(path, "/assets/") {
+			// static assets dont need a user token from db so bypass.
+			// images do, since who can see them depends on who is asking.
 			next(w, r)
 			return // the final return prevents execution after the next call.
 		}
-		cookie, err := r.Cookie("remember_token")
+		ip := clientIP(r, mw.TrustedProxies)
+		r = r.WithContext(context.WithIP(r.Context(), ip))
+		cookie, err := r.Cookie(models.SessionCookie)
 		if err != nil {
 			next(w, r)
 			return
 		}
 
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		session, err := mw.SessionService.ByToken(cookie.Value)
 		if err != nil {
 			next(w, r)
 			return
 		}
+		user, err := mw.UserService.ByID(session.UserID)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		err = mw.SessionService.Touch(session, ip)
+		switch err {
+		case nil:
+		case models.ErrNotFound:
+			// logged out between looking it up and now
+			next(w, r)
+			return
+		default:
+			// only the session list cares, not worth failing the request
+			fmt.Printf("Failed to update session %d: %s\n", session.ID, err)
+		}
 
 		// set the user on the context which uses our custom package
 		// to ensure typesafety.
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 		next(w, r)
 	})
 }
+
+// clientIP is where the request came from. When it came through one of our
+// trusted proxies that's the last address in X-Forwarded-For that isn't
+// another of them, since each proxy appends who it heard from and anything
+// before that the client could have made up. Without trusted proxies the
+// header is ignored altogether.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !isTrusted(addr, trusted) {
+		return addr
+	}
+	parts := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(parts[i])
+		if ip == "" {
+			break
+		}
+		addr = ip
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+	return addr
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
+	"github.com/jinzhu/gorm"
+)
+
+// blob is one original file in storage, shared by every image a user has
+// uploaded with the same contents. RefCount is how many images point at it,
+// when it hits zero the file can go. Stored is only set once the file has
+// been written, until then every upload of it writes it again itself.
+type blob struct {
+	ID       uint   `gorm:"primary_key"`
+	UserID   uint   `gorm:"not null;unique_index:idx_blobs_user_sha256"`
+	SHA256   string `gorm:"not null;unique_index:idx_blobs_user_sha256"`
+	RefCount int    `gorm:"not null"`
+	Stored   bool   `gorm:"not null;default:false"`
+}
+
+// blobKey is where a user's original with the given hash and extension is
+// kept. Everything under originals/ is shared between galleries so it is
+// only ever reached through an image row.
+func blobKey(userID uint, sha256, ext string) string {
+	return storage.JoinKey("originals", fmt.Sprintf("%v", userID), sha256+ext)
+}
+
+// BlobKey is where the image's original lives if it was stored by hash.
+func (i *Image) BlobKey() string {
+	return blobKey(i.UserID, i.SHA256, path.Ext(i.StorageName))
+}
+
+type blobDB interface {
+	// Acquire adds a reference to the user's blob with this hash, creating it
+	// if needed. It returns true when the file hasn't been stored yet, which
+	// includes while another upload of it is still being written or failed,
+	// meaning the caller has to write it to storage and then call Stored.
+	Acquire(userID uint, sha256 string) (bool, error)
+	// Stored marks the user's blob with this hash as written to storage.
+	Stored(userID uint, sha256 string) error
+	// Release drops a reference and returns true if it was the last one.
+	// Then remove is called, if it isn't nil, to delete the file while the
+	// blob is still locked, so an upload of the same file can't count on it
+	// in the meantime. If remove fails the reference is kept.
+	Release(userID uint, sha256 string, remove func() error) (bool, error)
+	// Exists is true if any image is still using the user's blob with this
+	// hash.
+	Exists(userID uint, sha256 string) (bool, error)
+}
+
+type blobGorm struct {
+	db *gorm.DB
+}
+
+var _ blobDB = &blobGorm{}
+
+func (bg *blobGorm) Acquire(userID uint, sha256 string) (bool, error) {
+	var stored bool
+	// a row nothing references any more may have lost its file, so it
+	// has to be written again
+	err := bg.db.Raw(`INSERT INTO blobs (user_id, sha256, ref_count, stored) VALUES (?, ?, 1, false)
+		ON CONFLICT (user_id, sha256) DO UPDATE SET ref_count = blobs.ref_count + 1,
+			stored = blobs.stored AND blobs.ref_count > 0
+		RETURNING stored`, userID, sha256).Row().Scan(&stored)
+	if err != nil {
+		return false, err
+	}
+	return !stored, nil
+}
+
+func (bg *blobGorm) Stored(userID uint, sha256 string) error {
+	return bg.db.Model(&blob{}).Where("user_id = ? AND sha256 = ?", userID, sha256).
+		UpdateColumn("stored", true).Error
+}
+
+// Release does everything in one transaction. The update locks the row, so
+// an Acquire of the same file waits until the file and row are both gone
+// and then starts over with a new row that needs the file written again.
+func (bg *blobGorm) Release(userID uint, sha256 string, remove func() error) (bool, error) {
+	tx := bg.db.Begin()
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	var refs int
+	err := tx.Raw(`UPDATE blobs SET ref_count = ref_count - 1
+		WHERE user_id = ? AND sha256 = ? RETURNING ref_count`, userID, sha256).Row().Scan(&refs)
+	switch {
+	case err == sql.ErrNoRows:
+		// nothing is counting references to it so nothing else can be using it
+		tx.Rollback()
+		if remove != nil {
+			if err := remove(); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case err != nil:
+		tx.Rollback()
+		return false, err
+	case refs > 0:
+		return false, tx.Commit().Error
+	}
+
+	db := tx.Where("user_id = ? AND sha256 = ? AND ref_count <= 0", userID, sha256).Delete(&blob{})
+	if db.Error != nil {
+		tx.Rollback()
+		return false, db.Error
+	}
+	if db.RowsAffected == 0 {
+		// can't happen while we hold the lock, but if it does someone else
+		// has the file now
+		return false, tx.Commit().Error
+	}
+	if remove != nil {
+		if err := remove(); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	return true, tx.Commit().Error
+}
+
+func (bg *blobGorm) Exists(userID uint, sha256 string) (bool, error) {
+	var count int
+	err := bg.db.Model(&blob{}).Where("user_id = ? AND sha256 = ? AND ref_count > 0", userID, sha256).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrVerifyTokenInvalid is returned for a verification link that's
+	// made up, expired or for an address the user no longer has.
+	ErrVerifyTokenInvalid modelError = "models: that verification link is invalid or has expired"
+	// ErrEmailAlreadyVerified is returned when asking to verify an address
+	// that already has been.
+	ErrEmailAlreadyVerified modelError = "models: your email address is already verified"
+	// ErrVerifyTooSoon is returned when asking for another link right after
+	// the last one, so the button can't be used to flood someone's inbox.
+	ErrVerifyTooSoon modelError = "models: we just sent you a link, please wait a minute before asking for another"
+	// ErrEmailUnchanged is returned when changing email to the one the user
+	// already has.
+	ErrEmailUnchanged modelError = "models: that's already your email address"
+)
+
+const (
+	// emailVerificationDuration is how long verification links work for.
+	emailVerificationDuration = 48 * time.Hour
+	// verificationResendInterval is how long to wait between sending links.
+	verificationResendInterval = time.Minute
+)
+
+// EmailVerified is true once the user has followed a link sent to their
+// email address.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// emailVerification is a link sent to Email to prove UserID can read it.
+// Like pwReset only the token's hash is stored.
+type emailVerification struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	Email  string `gorm:"not null"`
+	// Change is set when Email is a new address the user wants to switch
+	// to, which only happens once they follow the link.
+	Change    bool   `gorm:"not null;default:false"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+type emailVerificationDB interface {
+	ByToken(token string) (*emailVerification, error)
+	// LatestByUserID is the last verification started for the user.
+	LatestByUserID(userID uint) (*emailVerification, error)
+	Create(ev *emailVerification) error
+	// DeleteByUserID deletes all of the user's verifications, so old links
+	// stop working once one of them has been used.
+	DeleteByUserID(userID uint) error
+}
+
+func (us *userService) InitiateVerification(user *User) (string, error) {
+	if user.EmailVerified() {
+		return "", ErrEmailAlreadyVerified
+	}
+	if err := us.verifyNotTooSoon(user); err != nil {
+		return "", err
+	}
+
+	ev := emailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+	}
+	if err := us.verifyDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+func (us *userService) CompleteVerification(token string) (*User, error) {
+	ev, err := us.verifyDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrVerifyTokenInvalid
+		}
+		return nil, err
+	}
+	if time.Since(ev.CreatedAt) > emailVerificationDuration {
+		return nil, ErrVerifyTokenInvalid
+	}
+	user, err := us.ByID(ev.UserID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrVerifyTokenInvalid
+		}
+		return nil, err
+	}
+	switch {
+	case ev.Change:
+		// Update checks again that nobody has taken the address since
+		user.Email = ev.Email
+		user.EmailVerifiedAt = nil
+	case ev.Email != user.Email:
+		// sent before they changed address, so it proves nothing about
+		// the one they have now
+		return nil, ErrVerifyTokenInvalid
+	}
+
+	if !user.EmailVerified() {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		if err := us.Update(user); err != nil {
+			return nil, err
+		}
+	}
+	if err := us.verifyDB.DeleteByUserID(user.ID); err != nil {
+		fmt.Printf("Failed to delete email verifications for user %d: %s\n", user.ID, err)
+	}
+	return user, nil
+}
+
+func (us *userService) InitiateEmailChange(user *User, email, password string) (string, string, error) {
+	if err := us.checkPassword(user, password); err != nil {
+		return "", "", err
+	}
+	// the same checks as saving the user would do, now rather than once
+	// they've followed the link
+	candidate := User{Email: email}
+	candidate.ID = user.ID
+	if err := runUserValFns(&candidate,
+		us.validator.requireEmail,
+		us.validator.normalizeEmail,
+		us.validator.emailFormat,
+		us.validator.emailIsAvail); err != nil {
+		return "", "", err
+	}
+	if candidate.Email == user.Email {
+		return "", "", ErrEmailUnchanged
+	}
+	if err := us.verifyNotTooSoon(user); err != nil {
+		return "", "", err
+	}
+
+	ev := emailVerification{
+		UserID: user.ID,
+		Email:  candidate.Email,
+		Change: true,
+	}
+	if err := us.verifyDB.Create(&ev); err != nil {
+		return "", "", err
+	}
+	return ev.Token, ev.Email, nil
+}
+
+func (us *userService) PendingEmail(user *User) (string, error) {
+	latest, err := us.verifyDB.LatestByUserID(user.ID)
+	switch {
+	case err == ErrNotFound:
+		return "", nil
+	case err != nil:
+		return "", err
+	case !latest.Change || time.Since(latest.CreatedAt) > emailVerificationDuration:
+		return "", nil
+	}
+	return latest.Email, nil
+}
+
+// verifyNotTooSoon returns ErrVerifyTooSoon if the user was sent a link in
+// the last verificationResendInterval.
+func (us *userService) verifyNotTooSoon(user *User) error {
+	latest, err := us.verifyDB.LatestByUserID(user.ID)
+	switch err {
+	case nil:
+		if time.Since(latest.CreatedAt) < verificationResendInterval {
+			return ErrVerifyTooSoon
+		}
+		return nil
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+type emailVerificationValidator struct {
+	emailVerificationDB
+	hmac hash.HMAC
+}
+
+func newEmailVerificationValidator(db emailVerificationDB, hmac hash.HMAC) *emailVerificationValidator {
+	return &emailVerificationValidator{
+		emailVerificationDB: db,
+		hmac:                hmac,
+	}
+}
+
+func (evv *emailVerificationValidator) ByToken(token string) (*emailVerification, error) {
+	ev := emailVerification{Token: token}
+	if err := runEmailVerificationValFns(&ev, evv.hmacToken); err != nil {
+		return nil, err
+	}
+	return evv.emailVerificationDB.ByToken(ev.TokenHash)
+}
+
+func (evv *emailVerificationValidator) Create(ev *emailVerification) error {
+	if err := runEmailVerificationValFns(ev,
+		evv.requireUserID,
+		evv.requireEmail,
+		evv.setTokenIfUnset,
+		evv.hmacToken); err != nil {
+		return err
+	}
+	return evv.emailVerificationDB.Create(ev)
+}
+
+func (evv *emailVerificationValidator) DeleteByUserID(userID uint) error {
+	if userID == 0 {
+		return ErrUserIDRequired
+	}
+	return evv.emailVerificationDB.DeleteByUserID(userID)
+}
+
+func (evv *emailVerificationValidator) requireUserID(ev *emailVerification) error {
+	if ev.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) requireEmail(ev *emailVerification) error {
+	if ev.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) setTokenIfUnset(ev *emailVerification) error {
+	if ev.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ev.Token = token
+	return nil
+}
+
+func (evv *emailVerificationValidator) hmacToken(ev *emailVerification) error {
+	if ev.Token == "" {
+		return nil
+	}
+	ev.TokenHash = evv.hmac.Hash(ev.Token)
+	return nil
+}
+
+type emailVerificationGorm struct {
+	db *gorm.DB
+}
+
+var _ emailVerificationDB = &emailVerificationGorm{}
+
+func (evg *emailVerificationGorm) ByToken(tokenHash string) (*emailVerification, error) {
+	var ev emailVerification
+	db := evg.db.Where("token_hash = ?", tokenHash)
+	if err := first(db, &ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (evg *emailVerificationGorm) LatestByUserID(userID uint) (*emailVerification, error) {
+	var ev emailVerification
+	db := evg.db.Where("user_id = ?", userID).Order("created_at desc")
+	if err := first(db, &ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (evg *emailVerificationGorm) Create(ev *emailVerification) error {
+	return evg.db.Create(ev).Error
+}
+
+func (evg *emailVerificationGorm) DeleteByUserID(userID uint) error {
+	return evg.db.Unscoped().Where("user_id = ?", userID).Delete(&emailVerification{}).Error
+}
+
+type emailVerificationValFn func(*emailVerification) error
+
+func runEmailVerificationValFns(ev *emailVerification, fns ...emailVerificationValFn) error {
+	for _, fn := range fns {
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
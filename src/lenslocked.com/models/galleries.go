@@ -1,14 +1,143 @@
 package models
 
 import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
 	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	UserID uint   `gorm:"not null;index"`
+	Title  string `gorm:"not_null"`
+	// MetadataPolicy decides how much of each photo's EXIF data the public
+	// gets to see, one of the Metadata* constants.
+	MetadataPolicy string
+	// Visibility is who can see the gallery, one of the Visibility* constants.
+	Visibility string
+	// ShareToken is the secret part of an unlisted gallery's link.
+	ShareToken string `gorm:"index"`
+	// Password is a passphrase visitors need on top of whatever got them to
+	// the gallery. Only the bcrypt hash is kept.
+	Password     string `gorm:"-"`
+	PasswordHash string
+	// RemovePassword clears the password on the next Update.
+	RemovePassword bool `gorm:"-"`
+	// CoverImageID is the image picked to represent the gallery, zero means
+	// just use the first one.
+	CoverImageID uint
+	Images       []Image `gorm:"-"`
+	// CoverImage is filled in by whoever needs it, see ImageService.Cover.
+	CoverImage *Image `gorm:"-"`
+	// ShareLinks is filled in for the owner's edit page.
+	ShareLinks []ShareLink `gorm:"-"`
+	// DownloadPath is where the gallery page links to for a zip of the
+	// whole thing, which depends on how the visitor got to the page.
+	DownloadPath string `gorm:"-"`
+	// Uploads is filled in after a batch upload so the edit page can say how
+	// each file went.
+	Uploads []UploadResult `gorm:"-"`
+}
+
+const (
+	// MetadataKeep serves photos exactly as uploaded, location and all.
+	MetadataKeep = "keep"
+	// MetadataStripLocation removes GPS tags but keeps camera details. It is
+	// the default since nobody expects a photo to give away their address.
+	MetadataStripLocation = "strip_location"
+	// MetadataStripAll removes every bit of metadata from served photos.
+	MetadataStripAll = "strip_all"
+)
+
+const (
+	// VisibilityPrivate galleries can only be seen by their owner. Galleries
+	// from before we had visibility are private.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries can be seen by anyone with the link,
+	// which has ShareToken in it rather than the guessable ID.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries can be seen by anyone.
+	VisibilityPublic = "public"
+)
+
+// IsProtected is true if visitors need the gallery's password.
+func (g *Gallery) IsProtected() bool {
+	return g.PasswordHash != ""
+}
+
+// Access is the gallery's visibility, treating unset as private.
+func (g *Gallery) Access() string {
+	if g.Visibility == "" {
+		return VisibilityPrivate
+	}
+	return g.Visibility
+}
+
+func (g *Gallery) IsPublic() bool {
+	return g.Access() == VisibilityPublic
+}
+
+func (g *Gallery) IsUnlisted() bool {
+	return g.Access() == VisibilityUnlisted
+}
+
+// OwnedBy is true if user is the gallery's owner. user can be nil.
+func (g *Gallery) OwnedBy(user *User) bool {
+	return user != nil && user.ID == g.UserID
+}
+
+// CanView is true if user can see the gallery at its normal URL, which for
+// anything but a public gallery means being its owner. Unlisted galleries
+// are reached through their link instead, see ShareTokenMatches.
+func (g *Gallery) CanView(user *User) bool {
+	return g.OwnedBy(user) || g.IsPublic()
+}
+
+// ShareTokenMatches checks token against an unlisted gallery's ShareToken
+// without leaking how much of it matched through timing.
+func (g *Gallery) ShareTokenMatches(token string) bool {
+	if !g.IsUnlisted() || g.ShareToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(g.ShareToken), []byte(token)) == 1
+}
+
+// Metadata is the gallery's metadata policy, with galleries from before we
+// had one treated as MetadataStripLocation.
+func (g *Gallery) Metadata() string {
+	if g.MetadataPolicy == "" {
+		return MetadataStripLocation
+	}
+	return g.MetadataPolicy
+}
+
+// ShowsLocation is true if the gallery is happy for people to see where
+// its photos were taken.
+func (g *Gallery) ShowsLocation() bool {
+	return g.Metadata() == MetadataKeep
+}
+
+// ShowsCamera is true if camera and exposure details can be shown.
+func (g *Gallery) ShowsCamera() bool {
+	return g.Metadata() != MetadataStripAll
+}
+
+// IsCover is true if the image with this ID is the gallery's cover out of
+// the loaded Images, the same one ImageService.Cover would pick.
+func (g *Gallery) IsCover(imageID uint) bool {
+	for _, img := range g.Images {
+		if img.ID == g.CoverImageID {
+			return img.ID == imageID
+		}
+	}
+	return len(g.Images) > 0 && g.Images[0].ID == imageID
 }
 
 func (g *Gallery) ImagesSplitN(nColumns int) [][]Image {
@@ -31,18 +160,52 @@ var (
 	ErrUserIDRequired    modelError = "models: UserID is required on this gallery"
 	ErrGalleryIdRequired modelError = "models: GalleryID is required"
 	ErrTitleRequired     modelError = "models: Title is required on this gallery"
+	// ErrVisibilityInvalid is returned for anything but one of the Visibility* constants
+	ErrVisibilityInvalid modelError = "models: gallery visibility must be private, unlisted or public"
+	// ErrGalleryPasswordTooShort is returned when a gallery password is under minGalleryPasswordLen
+	ErrGalleryPasswordTooShort modelError = "models: gallery passwords must be at least 8 characters long"
+	// ErrGalleryPasswordIncorrect is returned when unlocking with the wrong password
+	ErrGalleryPasswordIncorrect modelError = "models: that password isn't right for this gallery"
+	// ErrMetadataPolicyInvalid is returned for anything but one of the Metadata* constants
+	ErrMetadataPolicyInvalid modelError = "models: photo metadata setting is invalid"
+)
+
+const (
+	minGalleryPasswordLen = 8
+	// GalleryUnlockDuration is how long a visitor stays unlocked after
+	// entering a gallery's password.
+	GalleryUnlockDuration = 7 * 24 * time.Hour
 )
 
 type GalleryService interface {
+	// Unlock checks password against a protected gallery's and returns a
+	// signed value proving it was entered, for the visitor to keep in a
+	// cookie. ErrGalleryPasswordIncorrect is returned if it doesn't match
+	// and ErrGalleryUnlockThrottled once ip has tried too many times.
+	Unlock(gallery *Gallery, password, ip string) (string, error)
+	// Unlocked is true if value came from Unlock for this gallery, hasn't
+	// expired and the password hasn't changed since.
+	Unlocked(gallery *Gallery, value string) bool
+	// PurgeTrash purges every gallery that was put in the trash before
+	// before and returns how many there were.
+	PurgeTrash(before time.Time) (int, error)
 	GalleryDB
 }
 
 type galleryService struct {
 	GalleryDB
+	pepper  string
+	hmac    hash.HMAC
+	usage   UsageService
+	unlocks unlockAttemptDB
+	// images is set by WithImage, which needs galleries itself so can't be
+	// passed in. Purging a gallery purges its images through it.
+	images ImageService
 }
 
 type galleryValidator struct {
 	GalleryDB
+	pepper string
 }
 
 // todo eli doesn't understand what this does or why it matters
@@ -50,19 +213,69 @@ var _ GalleryDB = &galleryGorm{}
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+	// ByShareToken finds the unlisted gallery with this token.
+	ByShareToken(token string) (*Gallery, error)
 	ByUserID(id uint) ([]*Gallery, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
+	// Delete moves the gallery to the trash, see Purge for getting rid of it.
 	Delete(id uint) error
+	galleryTrashDB
 }
 
-func NewGalleryService(db *gorm.DB) GalleryService {
+func NewGalleryService(db *gorm.DB, pepper, hmacSecretKey string, usage UsageService) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{
 			GalleryDB: &galleryGorm{
 				db: db,
-			}},
+			},
+			pepper: pepper,
+		},
+		pepper:  pepper,
+		hmac:    hash.NewHMAC(hmacSecretKey),
+		usage:   usage,
+		unlocks: &unlockAttemptGorm{db: db},
+	}
+}
+
+func (gs *galleryService) Unlock(gallery *Gallery, password, ip string) (string, error) {
+	attempts, err := gs.unlocks.Attempt(gallery.ID, ip)
+	if err != nil {
+		return "", err
+	}
+	if attempts > maxUnlockAttempts {
+		return "", ErrGalleryUnlockThrottled
+	}
+	pepperedPWBytes := []byte(password + gs.pepper)
+	err = bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash), pepperedPWBytes)
+	if err != nil {
+		return "", ErrGalleryPasswordIncorrect
+	}
+	if err := gs.unlocks.Reset(gallery.ID, ip); err != nil {
+		// they'll just have fewer tries next time
+		fmt.Printf("Failed to reset unlock attempts for gallery %d: %s\n", gallery.ID, err)
 	}
+	expires := time.Now().Add(GalleryUnlockDuration).Unix()
+	return fmt.Sprintf("%d.%s", expires, gs.unlockSignature(gallery, expires)), nil
+}
+
+func (gs *galleryService) Unlocked(gallery *Gallery, value string) bool {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !gallery.IsProtected() {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	want := gs.unlockSignature(gallery, expires)
+	return subtle.ConstantTimeCompare([]byte(want), []byte(parts[1])) == 1
+}
+
+// unlockSignature signs the gallery, expiry and current password hash, so
+// changing the password locks everyone out again.
+func (gs *galleryService) unlockSignature(gallery *Gallery, expires int64) string {
+	return gs.hmac.Hash(fmt.Sprintf("gallery-unlock:%d:%d:%s", gallery.ID, expires, gallery.PasswordHash))
 }
 
 type galleryGorm struct {
@@ -83,6 +296,61 @@ func (gv *galleryValidator) hasTitle(gallery *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) metadataPolicyValid(gallery *Gallery) error {
+	gallery.MetadataPolicy = gallery.Metadata()
+	switch gallery.MetadataPolicy {
+	case MetadataKeep, MetadataStripLocation, MetadataStripAll:
+		return nil
+	}
+	return ErrMetadataPolicyInvalid
+}
+
+// visibilityValid checks the visibility and makes sure unlisted galleries
+// have a token for their link. The token is kept if the gallery is switched
+// away from unlisted and back so old links start working again.
+func (gv *galleryValidator) visibilityValid(gallery *Gallery) error {
+	gallery.Visibility = gallery.Access()
+	switch gallery.Visibility {
+	case VisibilityPrivate, VisibilityPublic:
+		return nil
+	case VisibilityUnlisted:
+		if gallery.ShareToken != "" {
+			return nil
+		}
+		token, err := rand.String(rand.RememberTokenBytes)
+		if err != nil {
+			return err
+		}
+		gallery.ShareToken = token
+		return nil
+	}
+	return ErrVisibilityInvalid
+}
+
+// bcryptPassword hashes a new gallery password the same way user passwords
+// are, see userValidator.bcryptPassword.
+func (gv *galleryValidator) bcryptPassword(gallery *Gallery) error {
+	if gallery.RemovePassword {
+		gallery.PasswordHash = ""
+		return nil
+	}
+	if gallery.Password == "" {
+		// unchanged
+		return nil
+	}
+	if len(gallery.Password) < minGalleryPasswordLen {
+		return ErrGalleryPasswordTooShort
+	}
+	pepperedPWBytes := []byte(gallery.Password + gv.pepper)
+	hashedBytes, err := bcrypt.GenerateFromPassword(pepperedPWBytes, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	gallery.PasswordHash = string(hashedBytes)
+	gallery.Password = ""
+	return nil
+}
+
 func (gv *galleryValidator) hasValidId(gallery *Gallery) error {
 	if gallery.ID == 0 {
 		return ErrGalleryIdRequired
@@ -114,6 +382,22 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gallery, nil
 }
 
+func (gv *galleryValidator) ByShareToken(token string) (*Gallery, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return gv.GalleryDB.ByShareToken(token)
+}
+
+func (gg *galleryGorm) ByShareToken(token string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("share_token = ? AND visibility = ?", token, VisibilityUnlisted)
+	if err := first(db, &gallery); err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
 func (gg *galleryGorm) ByUserID(userID uint) ([]*Gallery, error) {
 	var galleries []*Gallery
 	db := gg.db.Where("user_id = ?", userID)
@@ -127,6 +411,9 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 	if err := runGalleryValFns(gallery, []galleryValFn{
 		gv.hasValidUserId,
 		gv.hasTitle,
+		gv.visibilityValid,
+		gv.metadataPolicyValid,
+		gv.bcryptPassword,
 	}...); err != nil {
 		return err
 	}
@@ -145,6 +432,9 @@ func (gv *galleryValidator) Update(gallery *Gallery) error {
 	if err := runGalleryValFns(gallery,
 		gv.hasValidUserId,
 		gv.hasTitle,
+		gv.visibilityValid,
+		gv.metadataPolicyValid,
+		gv.bcryptPassword,
 		gv.hasValidId); err != nil {
 		return err
 	}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
+)
+
+// galleryPrefix is everything kept in storage for the gallery, its legacy
+// originals, variants and sanitized copies. Originals stored by hash live
+// under originals/ instead since other galleries can share them.
+func galleryPrefix(galleryID uint) string {
+	return storage.JoinKey("galleries", fmt.Sprintf("%v", galleryID)) + "/"
+}
+
+// PurgeByGallery purges every image in the gallery through Purge, so
+// shared originals and usage are handled like any other purge, then clears
+// out anything still stored under the gallery. It carries on past images it
+// can't purge and returns the first error, whatever is left behind gets
+// picked up by Reconcile.
+func (is *imageService) PurgeByGallery(galleryID uint) error {
+	images, err := is.ImageDB.AllByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	var first error
+	for i := range images {
+		if err := is.Purge(&images[i]); err != nil {
+			fmt.Printf("Failed to purge image %d of gallery %d: %s\n", images[i].ID, galleryID, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		// anything left might still be an original one of those images needs
+		return first
+	}
+
+	objects, err := is.store.List(galleryPrefix(galleryID))
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := is.store.Delete(obj.Key); err != nil {
+			fmt.Printf("Failed to delete %s: %s\n", obj.Key, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Reconcile looks through storage for files nothing points at any more and
+// deletes them, or with dryRun just lists them. That's anything under a
+// gallery that doesn't exist, variants and sanitized copies of images that
+// are gone and originals no image is sharing. Galleries and images in the
+// trash still exist as far as this is concerned. Originals under a gallery that
+// still exists are left alone since Backfill may still want them. It returns
+// the keys of what it found.
+func (is *imageService) Reconcile(dryRun bool) ([]string, error) {
+	objects, err := is.store.List("galleries/")
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := is.store.List("originals/")
+	if err != nil {
+		return nil, err
+	}
+	objects = append(objects, blobs...)
+
+	galleries := map[uint]bool{}
+	var orphans []string
+	for _, obj := range objects {
+		orphaned, err := is.orphaned(obj.Key, galleries)
+		if err != nil {
+			return orphans, err
+		}
+		if !orphaned {
+			continue
+		}
+		orphans = append(orphans, obj.Key)
+		if dryRun {
+			continue
+		}
+		if err := is.store.Delete(obj.Key); err != nil {
+			return orphans, err
+		}
+	}
+
+	// deleting files on disk cleans up the directories they leave empty, but
+	// not ones emptied before it did
+	if pruner, ok := is.store.(interface {
+		PruneEmpty(prefix string) ([]string, error)
+	}); ok && !dryRun {
+		for _, prefix := range []string{"galleries/", "originals/"} {
+			dirs, err := pruner.PruneEmpty(prefix)
+			if err != nil {
+				return orphans, err
+			}
+			orphans = append(orphans, dirs...)
+		}
+	}
+	return orphans, nil
+}
+
+// orphaned is true if nothing points at the file at key. galleries caches
+// which gallery IDs exist between calls.
+func (is *imageService) orphaned(key string, galleries map[uint]bool) (bool, error) {
+	parts := strings.Split(key, "/")
+	if parts[0] == "originals" {
+		// originals/:user_id/:sha256.ext
+		if len(parts) != 3 {
+			return false, nil
+		}
+		userID, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return false, nil
+		}
+		sha256 := strings.TrimSuffix(parts[2], path.Ext(parts[2]))
+		used, err := is.blobs.Exists(uint(userID), sha256)
+		return !used, err
+	}
+
+	// galleries/:id/... for everything else
+	if len(parts) < 3 {
+		return false, nil
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return false, nil
+	}
+	galleryID := uint(id)
+	exists, ok := galleries[galleryID]
+	if !ok {
+		_, err := is.galleries.ByID(galleryID)
+		if err == ErrNotFound {
+			_, err = is.galleries.TrashedByID(galleryID)
+		}
+		switch err {
+		case nil:
+			exists = true
+		case ErrNotFound:
+			exists = false
+		default:
+			return false, err
+		}
+		galleries[galleryID] = exists
+	}
+	if !exists {
+		return true, nil
+	}
+
+	var name string
+	switch {
+	case len(parts) == 5 && parts[2] == "variants":
+		// galleries/:id/variants/:variant/:storage_name.jpg
+		name = strings.TrimSuffix(parts[4], ".jpg")
+	case len(parts) == 4 && parts[2] == "public":
+		// galleries/:id/public/:storage_name
+		name = parts[3]
+	default:
+		// an original, or something we don't know about, leave it be
+		return false, nil
+	}
+	if !safeName(name) {
+		// not a name we'd have made, so not ours to delete
+		return false, nil
+	}
+	used, err := is.ImageDB.HasStorageName(galleryID, name)
+	return !used, err
+}
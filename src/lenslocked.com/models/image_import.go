@@ -0,0 +1,171 @@
+package models
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// maxImportFiles is the most entries a zip we import can have.
+	maxImportFiles = 2000
+	// maxImportBytes is the most a zip we import can add up to once
+	// extracted, about 2000 photos straight off a good camera.
+	maxImportBytes = 20 << 30 // 20 gb
+	// maxImportRatio is how many times smaller than its contents an entry
+	// can be compressed. Photos are already compressed so barely shrink at
+	// all, anything shrinking this much is a zip bomb or not a photo.
+	maxImportRatio = 50
+)
+
+var (
+	// ErrArchiveInvalid is returned for imports that can't be read as a zip
+	ErrArchiveInvalid modelError = "models: that file isn't a zip archive we can read"
+	// ErrArchiveTooManyFiles is returned for zips with more than maxImportFiles entries
+	ErrArchiveTooManyFiles modelError = "models: zips can have at most 2000 files in them, try splitting it up"
+	// ErrArchiveTooLarge is returned for zips that extract to more than maxImportBytes
+	ErrArchiveTooLarge modelError = "models: zips can add up to at most 20GB of photos, try splitting it up"
+	// ErrArchiveEntryUnsafe is returned for entries with paths that try to
+	// escape the archive, like ../../etc/passwd
+	ErrArchiveEntryUnsafe modelError = "models: this file's path in the zip isn't allowed"
+	// ErrArchiveEntryCompression is returned for entries compressed more
+	// than any photo could be
+	ErrArchiveEntryCompression modelError = "models: this file is compressed suspiciously well for a photo"
+	// ErrArchiveEntryUnreadable is returned for entries that are encrypted,
+	// use a compression method we don't know or are damaged
+	ErrArchiveEntryUnreadable modelError = "models: this file couldn't be extracted from the zip"
+)
+
+// UploadResult is how one file in a batch upload or import went.
+type UploadResult struct {
+	Filename string
+	Err      error
+}
+
+// Skipped is true for files that were left out because they were already
+// in the gallery, which isn't worth calling a failure.
+func (u UploadResult) Skipped() bool {
+	return u.Err == ErrImageDuplicate
+}
+
+func (u UploadResult) Failed() bool {
+	return u.Err != nil && !u.Skipped()
+}
+
+// Message says what happened to the file in a way that is safe to show the
+// person who uploaded it.
+func (u UploadResult) Message() string {
+	if u.Err == nil {
+		return "Uploaded"
+	}
+	if pErr, ok := u.Err.(interface{ Public() string }); ok {
+		return pErr.Public()
+	}
+	return "Something went wrong saving this photo"
+}
+
+// Import adds every photo in the zip to the gallery through Create, so they
+// get exactly the same checks as ones uploaded on their own. Entries are
+// never written out under their own names so a path like ../../x can't
+// land anywhere, and how much gets extracted is capped using both what the
+// zip claims and what actually comes out of it. It only returns an error if
+// the zip as a whole is unusable, anything wrong with a single photo is in
+// its UploadResult.
+func (is *imageService) Import(gallery *Gallery, r io.ReaderAt, size int64) ([]UploadResult, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, ErrArchiveInvalid
+	}
+	if len(zr.File) > maxImportFiles {
+		return nil, ErrArchiveTooManyFiles
+	}
+	var total uint64
+	for _, f := range zr.File {
+		total += f.UncompressedSize64
+	}
+	if total > maxImportBytes {
+		return nil, ErrArchiveTooLarge
+	}
+
+	var results []UploadResult
+	for _, f := range zr.File {
+		name, ok := importName(f.Name)
+		if !ok {
+			results = append(results, UploadResult{Filename: f.Name, Err: ErrArchiveEntryUnsafe})
+			continue
+		}
+		if name == "" || f.FileInfo().IsDir() {
+			continue
+		}
+		image := Image{
+			GalleryID: gallery.ID,
+			UserID:    gallery.UserID,
+			Filename:  name,
+		}
+		results = append(results, UploadResult{
+			Filename: name,
+			Err:      is.importEntry(&image, f),
+		})
+	}
+	return results, nil
+}
+
+func (is *imageService) importEntry(image *Image, f *zip.File) error {
+	if f.UncompressedSize64 > maxImageBytes {
+		return ErrImageTooLarge
+	}
+	if f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > maxImportRatio {
+		return ErrArchiveEntryCompression
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return ErrArchiveEntryUnreadable
+	}
+	defer rc.Close()
+	// Create stops reading at maxImageBytes no matter what the header said,
+	// and zip checks the size and checksum once the entry has been read
+	return is.Create(image, entryReader{rc})
+}
+
+// importName is the filename to give an entry, just the last part of its
+// path. It returns false if the path tries to climb out of the archive and
+// "" for junk that isn't worth mentioning, like folders and the hidden
+// files macOS adds to every zip.
+func importName(name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(name) {
+		return "", false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+		if part == "." {
+			continue
+		}
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return "", true
+		}
+	}
+	if base := path.Base(name); base != "." && base != "/" {
+		return base, true
+	}
+	return "", true
+}
+
+// entryReader turns the errors reading a damaged entry can hit into one we
+// can show the uploader.
+type entryReader struct {
+	io.Reader
+}
+
+func (er entryReader) Read(p []byte) (int, error) {
+	n, err := er.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		fmt.Printf("Failed reading zip entry: %s\n", err)
+		err = ErrArchiveEntryUnreadable
+	}
+	return n, err
+}
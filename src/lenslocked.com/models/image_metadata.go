@@ -0,0 +1,192 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/exif"
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
+)
+
+// applyExif copies the EXIF fields we keep onto the image. Photos without
+// EXIF are perfectly normal so that isn't treated as an error.
+func applyExif(img *Image, b []byte) {
+	img.Orientation = 1
+	if img.ContentType != "image/jpeg" {
+		return
+	}
+	d, err := exif.Decode(bytes.NewReader(b))
+	if err != nil {
+		if err != exif.ErrNoExif {
+			fmt.Printf("Ignoring unreadable exif on %s: %s\n", img.Filename, err)
+		}
+		return
+	}
+	img.CameraMake = d.Make
+	img.CameraModel = d.Model
+	img.LensModel = d.LensModel
+	img.ExposureTime = d.ExposureTime
+	img.FNumber = d.FNumber
+	img.ISO = d.ISO
+	img.FocalLength = d.FocalLength
+	img.Orientation = d.Orientation
+	if !d.TakenAt.IsZero() {
+		taken := d.TakenAt
+		img.TakenAt = &taken
+	}
+	if d.HasGPS {
+		lat, lng := d.Latitude, d.Longitude
+		img.Latitude = &lat
+		img.Longitude = &lng
+	}
+	// we show photos the right way up, so width and height should match
+	if exif.Rotated(img.Orientation) {
+		img.Width, img.Height = img.Height, img.Width
+	}
+}
+
+// SanitizedKey is where the copy of the original with metadata stripped per
+// the gallery's setting is kept.
+func (i *Image) SanitizedKey() string {
+	return storage.JoinKey("galleries", fmt.Sprintf("%v", i.GalleryID), "public", i.StorageName)
+}
+
+// Camera is the make and model, without the make twice when the model
+// already includes it like "Canon Canon EOS R5".
+func (i *Image) Camera() string {
+	if strings.HasPrefix(i.CameraModel, i.CameraMake) {
+		return i.CameraModel
+	}
+	return strings.TrimSpace(i.CameraMake + " " + i.CameraModel)
+}
+
+// ExposureSummary is the settings a photographer cares about on one line,
+// eg "35mm f/1.8 1/250s ISO 200".
+func (i *Image) ExposureSummary() string {
+	var parts []string
+	if i.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%gmm", i.FocalLength))
+	}
+	if i.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", i.FNumber))
+	}
+	if i.ExposureTime != "" {
+		parts = append(parts, i.ExposureTime+"s")
+	}
+	if i.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", i.ISO))
+	}
+	return strings.Join(parts, " ")
+}
+
+// TakenOn is the capture date, or empty if the camera didn't record one.
+func (i *Image) TakenOn() string {
+	if i.TakenAt == nil {
+		return ""
+	}
+	return i.TakenAt.Format("Jan 2, 2006 3:04pm")
+}
+
+func (i *Image) HasMetadata() bool {
+	return i.Camera() != "" || i.ExposureSummary() != "" || i.TakenAt != nil
+}
+
+func (i *Image) HasLocation() bool {
+	return i.Latitude != nil && i.Longitude != nil
+}
+
+// MapURL links to where the photo was taken on OpenStreetMap.
+func (i *Image) MapURL() string {
+	if !i.HasLocation() {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=15/%f/%f",
+		*i.Latitude, *i.Longitude, *i.Latitude, *i.Longitude)
+}
+
+// PublicKey is the file to send anyone but the owner in place of the
+// original under the gallery's metadata policy. It's "" until the variants
+// job has made the stripped copy, the original can't be shown before then.
+func (i *Image) PublicKey(policy string) string {
+	switch {
+	case i.Sanitized:
+		return i.SanitizedKey()
+	case policy == MetadataKeep, i.ContentType == "image/gif":
+		// nothing to strip, see sanitize
+		return i.Key()
+	}
+	return ""
+}
+
+// sanitize writes (or removes) the copy of the original we serve in place of
+// it, following the gallery's metadata policy. src is the decoded image
+// already turned the right way up and b is the original file.
+func (is *imageService) sanitize(img *Image, policy string, b []byte, src image.Image) error {
+	if policy == MetadataKeep {
+		if img.Sanitized {
+			if err := is.store.Delete(img.SanitizedKey()); err != nil {
+				return err
+			}
+			img.Sanitized = false
+		}
+		return nil
+	}
+
+	var out []byte
+	var err error
+	switch img.ContentType {
+	case "image/jpeg":
+		stripAll := policy == MetadataStripAll
+		if !stripAll {
+			out, err = exif.StripGPS(b)
+			if err == exif.ErrGPSUnreadable {
+				// no telling where the location is hiding so everything
+				// has to go
+				stripAll, err = true, nil
+			}
+		}
+		if stripAll && img.Orientation > 1 {
+			// stripping everything loses the orientation tag, so bake the
+			// rotation into the pixels instead
+			var buf bytes.Buffer
+			err = jpeg.Encode(&buf, src, &jpeg.Options{Quality: 95})
+			out = buf.Bytes()
+		} else if stripAll {
+			out, err = exif.StripAll(b)
+		}
+	case "image/png":
+		// re-encoding drops any text or exif chunks and png is lossless
+		// anyway. src has been flattened for the jpeg variants so decode
+		// again to keep any transparency.
+		var orig image.Image
+		if orig, err = png.Decode(bytes.NewReader(b)); err == nil {
+			var buf bytes.Buffer
+			err = png.Encode(&buf, orig)
+			out = buf.Bytes()
+		}
+	case "image/webp":
+		// metadata is in its own chunks so it comes out without touching
+		// the pixels, and webp orientation tags are ignored by browsers
+		if policy == MetadataStripAll {
+			out, err = exif.StripAllWebP(b)
+		} else {
+			out, err = exif.StripGPSWebP(b)
+		}
+	default:
+		// gifs can't carry exif so they're served as uploaded
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := is.store.Put(img.SanitizedKey(), bytes.NewReader(out)); err != nil {
+		return err
+	}
+	img.Sanitized = true
+	return nil
+}
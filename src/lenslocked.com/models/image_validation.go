@@ -0,0 +1,173 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"io"
+	"net/http"
+	"os"
+)
+
+const (
+	// maxImageBytes is the biggest file we'll accept, comfortably bigger
+	// than anything a camera puts out.
+	maxImageBytes = 25 << 20 // 25 mb
+	// maxImagePixels stops decompression bombs, tiny files that claim to be
+	// enormous images and eat all our memory when we decode them to resize.
+	maxImagePixels = 60000000 // 60 megapixels
+	// maxImageSide is the longest either edge of an image can be.
+	maxImageSide = 16000
+)
+
+var (
+	// ErrImageTypeInvalid is returned when the upload isn't one of allowedImageTypes
+	ErrImageTypeInvalid modelError = "models: only JPEG, PNG, GIF and WebP images can be uploaded"
+	// ErrImageHEIC is returned for iphone photos, which we can't decode yet
+	ErrImageHEIC modelError = "models: HEIC photos aren't supported yet, please export them as JPEG and try again"
+	// ErrImageTooLarge is returned when the upload is bigger than maxImageBytes
+	ErrImageTooLarge modelError = "models: images must be 25MB or smaller"
+	// ErrImageDimensions is returned when the image has too many pixels to safely decode
+	ErrImageDimensions modelError = "models: images must be 60 megapixels or smaller and no more than 16000 pixels on a side"
+	// ErrImageCorrupt is returned when an image says it is one type but can't be read as one
+	ErrImageCorrupt modelError = "models: the image could not be read, it may be corrupt"
+	// ErrImageDuplicate is returned when the exact same file is already in the gallery
+	ErrImageDuplicate modelError = "models: this photo is already in the gallery"
+)
+
+// allowedImageTypes are the content types we accept, as sniffed from the
+// bytes themselves rather than trusting the filename or the browser.
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+const contentTypeHEIC = "image/heic"
+
+// spoolUpload copies r into a temp file so we can look at it more than once
+// before it goes anywhere permanent, working out its size and hex SHA-256
+// on the way. It gives up with ErrImageTooLarge as soon as more than
+// maxImageBytes have been read. The caller is responsible for closing and
+// removing the file.
+func spoolUpload(r io.Reader) (*os.File, int64, string, error) {
+	tmp, err := os.CreateTemp("", "lenslocked-upload-*")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, maxImageBytes+1))
+	if err == nil && n > maxImageBytes {
+		err = ErrImageTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, "", err
+	}
+	return tmp, n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sniffImage works out the image's real content type and dimensions from
+// its bytes. Only the header is decoded so this is safe to run on files
+// claiming to be huge, the validators decide if it is too big.
+func sniffImage(img *Image, r io.Reader) error {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+
+	if isHEIC(head) {
+		img.ContentType = contentTypeHEIC
+		return nil
+	}
+	img.ContentType = http.DetectContentType(head)
+	if !allowedImageTypes[img.ContentType] {
+		return nil
+	}
+
+	cfg, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return ErrImageCorrupt
+	}
+	img.Width = cfg.Width
+	img.Height = cfg.Height
+	return nil
+}
+
+// isHEIC looks for the ftyp box that starts every HEIF file, which
+// http.DetectContentType doesn't know about.
+func isHEIC(head []byte) bool {
+	if len(head) < 12 || !bytes.Equal(head[4:8], []byte("ftyp")) {
+		return false
+	}
+	switch string(head[8:12]) {
+	case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+func (iv *imageValidator) contentTypeAllowed(img *Image) error {
+	if img.ContentType == contentTypeHEIC {
+		return ErrImageHEIC
+	}
+	if !allowedImageTypes[img.ContentType] {
+		return ErrImageTypeInvalid
+	}
+	return nil
+}
+
+func (iv *imageValidator) sizeLimit(img *Image) error {
+	if img.Size > maxImageBytes {
+		return ErrImageTooLarge
+	}
+	return nil
+}
+
+func (iv *imageValidator) dimensionLimit(img *Image) error {
+	return checkDimensions(img.Width, img.Height)
+}
+
+// notDuplicate stops the same file going into a gallery twice, which is
+// what happens when a whole memory card gets uploaded again.
+func (iv *imageValidator) notDuplicate(img *Image) error {
+	if img.SHA256 == "" {
+		return nil
+	}
+	_, err := iv.ImageDB.BySHA256(img.GalleryID, img.SHA256)
+	switch err {
+	case nil:
+		return ErrImageDuplicate
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+func checkDimensions(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return ErrImageCorrupt
+	}
+	if width > maxImageSide || height > maxImageSide ||
+		int64(width)*int64(height) > maxImagePixels {
+		return ErrImageDimensions
+	}
+	return nil
+}
+
+// isModelError is true for the errors that mean the input was bad rather
+// than something going wrong on our end.
+func isModelError(err error) bool {
+	var me modelError
+	return errors.As(err, &me)
+}
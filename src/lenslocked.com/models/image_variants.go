@@ -0,0 +1,237 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"strings"
+
+	// registers the formats image.Decode understands
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/exif"
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
+	"golang.org/x/image/draw"
+)
+
+// imageVariant is a resized copy we make of every upload so pages don't
+// have to send down full size camera files. MaxWidth is as wide as the
+// variant gets, smaller images are never scaled up.
+type imageVariant struct {
+	Name     string
+	MaxWidth int
+}
+
+// imageVariants must stay ordered smallest to largest, Srcset relies on it.
+var imageVariants = []imageVariant{
+	{Name: "thumbnail", MaxWidth: 320},
+	{Name: "medium", MaxWidth: 960},
+	{Name: "large", MaxWidth: 1920},
+}
+
+const variantJPEGQuality = 85
+
+// ImageVariantNames lists the variants every image gets, smallest first.
+func ImageVariantNames() []string {
+	names := make([]string, len(imageVariants))
+	for i, v := range imageVariants {
+		names[i] = v.Name
+	}
+	return names
+}
+
+// JobImageVariants is the kind of job that runs GenerateVariants for an
+// uploaded image, its payload is an ImageJob.
+const JobImageVariants = "image.variants"
+
+type ImageJob struct {
+	ImageID uint `json:"image_id"`
+}
+
+// VariantKey is where the named variant of the image is kept in storage.
+// Variants are always jpegs no matter what was uploaded. There are no webp
+// variants, x/image only decodes webp and the encoders are cgo or need a
+// newer go than we build with.
+func (i *Image) VariantKey(name string) string {
+	return storage.JoinKey("galleries", fmt.Sprintf("%v", i.GalleryID), "variants", name, i.StorageName+".jpg")
+}
+
+// VariantPath is the URL for the named variant, falling back to the
+// original if that variant was never generated.
+func (i *Image) VariantPath(name string) string {
+	if !i.HasVariant(name) {
+		return i.Path()
+	}
+	return i.url(i.VariantKey(name))
+}
+
+func (i *Image) Thumbnail() string {
+	return i.VariantPath("thumbnail")
+}
+
+func (i *Image) HasVariant(name string) bool {
+	for _, v := range i.variantNames() {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Srcset is the value for an img srcset attribute listing every variant we
+// have along with its width, so the browser can pick the smallest one that
+// looks good on the screen it is on.
+func (i *Image) Srcset() string {
+	var entries []string
+	for _, v := range imageVariants {
+		if !i.HasVariant(v.Name) {
+			continue
+		}
+		entries = append(entries, fmt.Sprintf("%s %dw", i.VariantPath(v.Name), variantWidth(v, i.Width)))
+	}
+	return strings.Join(entries, ", ")
+}
+
+func (i *Image) variantNames() []string {
+	if i.Variants == "" {
+		return nil
+	}
+	return strings.Split(i.Variants, ",")
+}
+
+// variantWidth is how wide v ends up for an original that is width pixels wide.
+func variantWidth(v imageVariant, width int) int {
+	if width < v.MaxWidth {
+		return width
+	}
+	return v.MaxWidth
+}
+
+// GenerateVariants reads the original back out of storage and writes every
+// resized variant that makes sense for its size, plus the sanitized copy the
+// gallery's MetadataPolicy calls for. Then it records the dimensions, the
+// variants it got and the photo's EXIF details on the image row.
+func (is *imageService) GenerateVariants(image *Image) error {
+	gallery, err := is.galleries.ByID(image.GalleryID)
+	if err != nil {
+		return err
+	}
+
+	rc, err := is.store.Get(image.Key())
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(io.LimitReader(rc, maxImageBytes+1))
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	// check the header first so we never fully decode something huge
+	if err := sniffImage(image, bytes.NewReader(b)); err != nil && err != ErrImageCorrupt {
+		return err
+	}
+	applyExif(image, b)
+	if err := checkDimensions(image.Width, image.Height); err != nil {
+		return err
+	}
+
+	src, _, err := imageDecode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	src = exif.Orient(src, image.Orientation)
+
+	bounds := src.Bounds()
+	image.Width = bounds.Dx()
+	image.Height = bounds.Dy()
+
+	var names []string
+	for n, v := range imageVariants {
+		// once the original is narrower than the last variant anything bigger
+		// would just be the same picture again
+		if n > 0 && image.Width <= imageVariants[n-1].MaxWidth {
+			break
+		}
+		if err := is.writeVariant(image, v, src); err != nil {
+			return err
+		}
+		names = append(names, v.Name)
+	}
+	image.Variants = strings.Join(names, ",")
+
+	if err := is.sanitize(image, gallery.Metadata(), b, src); err != nil {
+		return err
+	}
+	return is.ImageDB.UpdateProcessed(image)
+}
+
+// RegenerateGallery queues a variants job for every image in the gallery.
+func (is *imageService) RegenerateGallery(galleryID uint) error {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if err := is.jobs.Enqueue(JobImageVariants, ImageJob{ImageID: image.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) writeVariant(img *Image, v imageVariant, src image.Image) error {
+	bounds := src.Bounds()
+	w := variantWidth(v, bounds.Dx())
+	h := bounds.Dy() * w / bounds.Dx()
+	if h == 0 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: variantJPEGQuality}); err != nil {
+		return err
+	}
+	_, err := is.store.Put(img.VariantKey(v.Name), &buf)
+	return err
+}
+
+// deleteVariants removes every variant the image has, including the
+// sanitized copy. Failures are only logged since a stray variant is harmless
+// once the row and original are gone.
+func (is *imageService) deleteVariants(image *Image) {
+	for _, name := range image.variantNames() {
+		if err := is.store.Delete(image.VariantKey(name)); err != nil {
+			fmt.Printf("Failed to delete %s variant of image %d: %s\n", name, image.ID, err)
+		}
+	}
+	if image.Sanitized {
+		if err := is.store.Delete(image.SanitizedKey()); err != nil {
+			fmt.Printf("Failed to delete sanitized copy of image %d: %s\n", image.ID, err)
+		}
+	}
+}
+
+// imageDecode is image.Decode with the white background jpegs need filled in
+// behind transparent pngs and gifs, otherwise they come out black.
+func imageDecode(r io.Reader) (image.Image, string, error) {
+	src, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if format == "jpeg" {
+		return src, format, nil
+	}
+	flat := image.NewRGBA(src.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, src.Bounds().Min, draw.Over)
+	return flat, format, nil
+}
@@ -5,98 +5,798 @@ import (
 	"io"
 	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
 	"github.com/jinzhu/gorm"
 )
 
-// Image is used to represent images stored in a gallery.
-// Instead references images stored on disk.
+var (
+	// ErrFilenameRequired is returned when an image is created without a filename
+	ErrFilenameRequired modelError = "models: filename is required on this image"
+	// ErrFilenameInvalid is returned when an uploaded filename looks like a path
+	ErrFilenameInvalid modelError = "models: filenames can't contain slashes, control characters or .. sequences"
+	// ErrStorageNameInvalid is returned when looking up an image by a name we could never have generated
+	ErrStorageNameInvalid modelError = "models: image name is invalid"
+	// ErrCaptionTooLong is returned when a caption is over maxCaptionLen
+	ErrCaptionTooLong modelError = "models: captions must be 500 characters or less"
+	// ErrAltTextTooLong is returned when alt text is over maxAltTextLen
+	ErrAltTextTooLong modelError = "models: alt text must be 250 characters or less"
+	// ErrImageOrderInvalid is returned when a new order names images that aren't in the gallery
+	ErrImageOrderInvalid modelError = "models: the new order doesn't match the images in this gallery"
+)
+
+const (
+	maxCaptionLen = 500
+	maxAltTextLen = 250
+)
+
+// Image is used to represent images stored in a gallery. The row keeps
+// track of who uploaded what and when, while the bytes themselves live in
+// whichever storage.Store the ImageService was set up with.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID uint `gorm:"not null;index"`
+	UserID    uint `gorm:"not null;index"`
+	// Filename is whatever the file was called on the uploader's computer.
+	// It is only ever shown to people, never used to find the file.
+	Filename string `gorm:"not null"`
+	// StorageName is the random name we generated for the file, see
+	// newStorageName. Images uploaded before we did that just reuse Filename.
+	StorageName string `gorm:"index"`
+	// SHA256 is the hex hash of the original. Images with the same hash
+	// belonging to the same user share one copy in storage, see blob.
+	// Images from before we hashed uploads don't have one.
+	SHA256 string `gorm:"index"`
+	Size   int64  `gorm:"not null"`
+	// ContentType is sniffed from the file itself, see allowedImageTypes.
+	ContentType string
+	Width       int
+	Height      int
+	// Variants is a comma separated list of the resized copies we have made,
+	// see imageVariants.
+	Variants string
+	// Position is where the image sits in its gallery, lowest first. New
+	// uploads go on the end.
+	Position int `gorm:"not null;default:0"`
+	Caption  string
+	// AltText describes the photo for people using screen readers.
+	AltText string
+
+	// What the camera recorded about the photo, see applyExif. Width and
+	// Height above are after the photo has been turned the right way up.
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	Orientation  int
+	Latitude     *float64
+	Longitude    *float64
+	// Sanitized is true when a copy with metadata removed per the gallery's
+	// MetadataPolicy is kept at SanitizedKey, in which case that is what
+	// gets served instead of the original.
+	Sanitized bool
+
+	// signer is set by the ImageService so SignedPath can sign URLs.
+	signer *hash.URLSigner
 }
 
+// imageEmbedTTL is how long the links from EmbedPath work for.
+const imageEmbedTTL = 24 * time.Hour
+
+// Path is the URL a browser can load the image from. Images are always
+// served by the app, even from S3, so who can see them can be checked.
 func (i *Image) Path() string {
+	if i.Sanitized {
+		return i.url(i.SanitizedKey())
+	}
+	return i.url(i.GalleryKey())
+}
+
+// SignedPath is Path signed so it loads for anyone who has it for at least
+// ttl, without the cookies, password or share link that would otherwise be
+// needed, eg when it's embedded in an email. Only hand these out where that
+// is what the owner wants. Expiries are rounded up to the hour so the same
+// link comes out for a while and browser caches still work. Without a
+// signer it's just Path.
+func (i *Image) SignedPath(ttl time.Duration) string {
+	path := i.Path()
+	if i.signer == nil {
+		return path
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Hour).Add(time.Hour)
+	return i.signer.Sign(path, expires)
+}
+
+// EmbedPath is SignedPath for imageEmbedTTL, for templates.
+func (i *Image) EmbedPath() string {
+	return i.SignedPath(imageEmbedTTL)
+}
+
+func (i *Image) url(key string) string {
 	temp := url.URL{
-		Path: "/" + i.RelativePath(),
+		Path: "/images/" + key,
 	}
-	return temp.String()
+	return temp.EscapedPath()
 }
 
-func (i *Image) RelativePath() string {
-	// convert the gallery id to a string
-	galleryID := fmt.Sprintf("%v", i.GalleryID)
-	return filepath.ToSlash(filepath.Join("images", "galleries", galleryID, i.Filename))
+// GalleryKey is the image's original under its gallery. It is only where
+// the file really lives for images that predate hashing, see Key, but it
+// is how every original is addressed in URLs.
+func (i *Image) GalleryKey() string {
+	return storage.JoinKey("galleries", fmt.Sprintf("%v", i.GalleryID), i.StorageName)
+}
+
+// Alt is the text for the img alt attribute, the caption will do if no alt
+// text was written.
+func (i *Image) Alt() string {
+	if i.AltText != "" {
+		return i.AltText
+	}
+	return i.Caption
+}
+
+// Key is where the image's original is kept in storage.
+func (i *Image) Key() string {
+	if i.SHA256 != "" {
+		return i.BlobKey()
+	}
+	return i.GalleryKey()
 }
 
 type ImageService interface {
-	Create(galleryID uint, r io.Reader, filename string) error
-	Delete(i *Image) error
+	// Create writes the image to storage and records it in the images table.
+	// If either step fails neither a row nor a file is left behind. Once the
+	// original is safely stored a job is queued to generate resized variants.
+	// Uploading a file that is already in the gallery returns
+	// ErrImageDuplicate, while one that is in another of the user's galleries
+	// reuses the copy already in storage.
+	Create(image *Image, r io.Reader) error
+	// Import runs every photo in a zip of size bytes through Create,
+	// returning how each one went.
+	Import(gallery *Gallery, r io.ReaderAt, size int64) ([]UploadResult, error)
+	// Delete moves the image to the trash. Its files stay put and still count
+	// against the owner until it is purged.
+	Delete(image *Image) error
+	// Purge removes the images row for good along with its variants in
+	// storage. The original is only deleted once no other image is using it.
+	Purge(image *Image) error
+	// PurgeByGallery purges every image in the gallery, trashed or not, along
+	// with anything else stored under it, for when the gallery itself is
+	// purged.
+	PurgeByGallery(galleryID uint) error
+	// PurgeTrash purges every image that was put in the trash before before
+	// and returns how many there were.
+	PurgeTrash(before time.Time) (int, error)
+	// GenerateVariants (re)builds the resized copies of an image that is
+	// already in storage, along with the copy that has its metadata stripped.
+	GenerateVariants(image *Image) error
+	// RegenerateGallery queues GenerateVariants for every image in the
+	// gallery, eg after its MetadataPolicy changes.
+	RegenerateGallery(galleryID uint) error
+	ByID(id uint) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByStorageName(galleryID uint, name string) (*Image, error)
+	// TrashedByUserID returns the images the user put in the trash on their
+	// own, see imageTrashDB.
+	TrashedByUserID(userID uint) ([]Image, error)
+	// TrashedByID finds an image only if it is in the trash.
+	TrashedByID(id uint) (*Image, error)
+	// Restore takes the image back out of the trash, as long as its gallery
+	// isn't in there too.
+	Restore(image *Image) error
+	// Open reads one of the image's files out of storage by its key, ie
+	// Key, VariantKey or SanitizedKey.
+	Open(key string) (storage.File, storage.Object, error)
+	// Update saves changes to the image's caption, alt text and the like.
+	Update(image *Image) error
+	// Reorder puts the gallery's images in the order of names, a list of
+	// storage names. Images left out keep their current order after the
+	// ones that were named.
+	Reorder(galleryID uint, names []string) error
+	// Cover is the image that represents the gallery, the one it picked or
+	// else its first. It returns ErrNotFound for an empty gallery.
+	Cover(gallery *Gallery) (*Image, error)
+	// Backfill creates rows for image files in storage that don't have one yet
+	// and returns how many it created.
+	Backfill() (int, error)
+	// Reconcile deletes files in storage that no gallery or image points at
+	// any more, or only lists them if dryRun is set, and returns their keys.
+	Reconcile(dryRun bool) ([]string, error)
+}
+
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
 	ByGalleryID(galleryID uint) ([]Image, error)
+	ByStorageName(galleryID uint, name string) (*Image, error)
+	BySHA256(galleryID uint, sha256 string) (*Image, error)
+	Create(image *Image) error
+	Update(image *Image) error
+	// UpdateProcessed saves only what GenerateVariants works out from the
+	// file, so captions or positions edited while it ran aren't reverted.
+	UpdateProcessed(image *Image) error
+	// SetPositions saves each image ID's index in ids as its position.
+	SetPositions(galleryID uint, ids []uint) error
+	// Delete moves the image to the trash, see Purge for getting rid of it.
+	Delete(id uint) error
+	imageTrashDB
 }
 
 type imageService struct {
+	ImageDB
+	store     storage.Store
+	jobs      JobService
+	galleries GalleryDB
+	blobs     blobDB
+	usage     UsageService
+	signer    *hash.URLSigner
+}
+
+type imageValidator struct {
+	ImageDB
+}
+
+type imageGorm struct {
 	db *gorm.DB
 }
 
-func NewImageService(db *gorm.DB) ImageService {
+var _ ImageDB = &imageGorm{}
+
+// NewImageService makes the image service. signer may be nil, in which case
+// image URLs are left unsigned.
+func NewImageService(db *gorm.DB, store storage.Store, jobs JobService, galleries GalleryDB, usage UsageService, signer *hash.URLSigner) ImageService {
 	return &imageService{
-		db: db,
+		ImageDB: &imageValidator{
+			ImageDB: &imageGorm{
+				db: db,
+			}},
+		store:     store,
+		jobs:      jobs,
+		galleries: galleries,
+		blobs:     &blobGorm{db: db},
+		usage:     usage,
+		signer:    signer,
 	}
 }
 
-func (is *imageService) Create(galleryID uint, r io.Reader, filename string) error {
-	galleryPath, err := is.mkImageDir(galleryID)
+func (is *imageService) ByID(id uint) (*Image, error) {
+	image, err := is.ImageDB.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	image.signer = is.signer
+	return image, nil
+}
+
+func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		images[i].signer = is.signer
+	}
+	return images, nil
+}
+
+func (is *imageService) ByStorageName(galleryID uint, name string) (*Image, error) {
+	image, err := is.ImageDB.ByStorageName(galleryID, name)
+	if err != nil {
+		return nil, err
+	}
+	image.signer = is.signer
+	return image, nil
+}
+
+func (is *imageService) Create(image *Image, r io.Reader) error {
+	tmp, size, sum, err := spoolUpload(r)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
 
-	dst, err := os.Create(filepath.Join(galleryPath, filename))
+	image.Size = size
+	image.SHA256 = sum
+	if err := sniffImage(image, tmp); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if image.ContentType == "image/jpeg" {
+		// exif lives in the first 64k of a jpeg so this never reads much
+		head := make([]byte, 64<<10)
+		n, _ := io.ReadFull(tmp, head)
+		applyExif(image, head[:n])
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if image.StorageName, err = newStorageName(image.ContentType); err != nil {
+		return err
+	}
+
+	// Usage is counted up front so two uploads racing for the last of the
+	// user's space can't both get in, and handed back if anything fails.
+	if err := is.usage.Reserve(image.UserID, image.Size); err != nil {
+		return err
+	}
+	// The row goes in first since that is where the upload gets validated,
+	// no sense storing a file we are about to reject.
+	if err := is.ImageDB.Create(image); err != nil {
+		is.usage.Release(image.UserID, image.Size)
+		return err
+	}
+	unstored, err := is.blobs.Acquire(image.UserID, image.SHA256)
 	if err != nil {
+		is.ImageDB.Purge(image.ID)
+		is.usage.Release(image.UserID, image.Size)
 		return err
 	}
-	defer dst.Close()
+	// only the first copy needs storing, the rest share it. A duplicate
+	// racing the first one writes the same bytes to the same key, which is
+	// harmless, rather than trusting a Put that might still fail.
+	if unstored {
+		if _, err := is.store.Put(image.Key(), tmp); err != nil {
+			// the file never made it so the row shouldn't stick around either
+			is.blobs.Release(image.UserID, image.SHA256, nil)
+			is.ImageDB.Purge(image.ID)
+			is.usage.Release(image.UserID, image.Size)
+			return err
+		}
+		if err := is.blobs.Stored(image.UserID, image.SHA256); err != nil {
+			// the file is there, the next duplicate just writes it again
+			fmt.Printf("Failed to mark original of image %d stored: %s\n", image.ID, err)
+		}
+	}
+	if err := is.jobs.Enqueue(JobImageVariants, ImageJob{ImageID: image.ID}); err != nil {
+		// the original is still perfectly viewable, it just won't have smaller copies
+		fmt.Printf("Failed to queue variants for image %d: %s\n", image.ID, err)
+	}
+	return nil
+}
+
+func (is *imageService) Delete(image *Image) error {
+	return is.ImageDB.Delete(image.ID)
+}
 
-	if _, err = io.Copy(dst, r); err != nil {
+func (is *imageService) Purge(image *Image) error {
+	if err := is.ImageDB.Purge(image.ID); err != nil {
 		return err
 	}
 
+	var err error
+	if image.SHA256 != "" {
+		// the original is only deleted along with the last reference, and
+		// if either fails the reference is still counted
+		_, err = is.blobs.Release(image.UserID, image.SHA256, func() error {
+			return is.store.Delete(image.Key())
+		})
+	} else {
+		err = is.store.Delete(image.Key())
+	}
+	if err != nil {
+		// the file is still there, and still counted if it's shared, so put
+		// the row back rather than orphaning it
+		if rerr := is.ImageDB.Unpurge(image); rerr != nil {
+			fmt.Printf("Failed to restore image %d after delete error: %s\n", image.ID, rerr)
+		}
+		return err
+	}
+	is.deleteVariants(image)
+	is.releaseUsage(image)
 	return nil
 }
 
-func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+// releaseUsage takes a deleted image off its owner's usage. Getting it
+// wrong isn't worth failing a delete over since Recount can fix it later.
+func (is *imageService) releaseUsage(image *Image) {
+	if err := is.usage.Release(image.UserID, image.Size); err != nil {
+		fmt.Printf("Failed to release usage for image %d: %s\n", image.ID, err)
+	}
+}
+
+func (is *imageService) Open(key string) (storage.File, storage.Object, error) {
+	return is.store.Open(key)
 }
 
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	dir := is.imageDir(galleryID)
-	strings, err := filepath.Glob(filepath.Join(dir, "*"))
+func (is *imageService) Reorder(galleryID uint, names []string) error {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
 	if err != nil {
+		return err
+	}
+	byName := make(map[string]uint, len(images))
+	for _, image := range images {
+		byName[image.StorageName] = image.ID
+	}
+
+	ids := make([]uint, 0, len(images))
+	seen := make(map[uint]bool, len(images))
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok || seen[id] {
+			return ErrImageOrderInvalid
+		}
+		ids = append(ids, id)
+		seen[id] = true
+	}
+	for _, image := range images {
+		if !seen[image.ID] {
+			ids = append(ids, image.ID)
+		}
+	}
+	return is.ImageDB.SetPositions(galleryID, ids)
+}
+
+func (is *imageService) Cover(gallery *Gallery) (*Image, error) {
+	if gallery.CoverImageID != 0 {
+		image, err := is.ByID(gallery.CoverImageID)
+		if err == nil && image.GalleryID == gallery.ID {
+			return image, nil
+		}
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		// the cover was deleted, fall back to the first image
+	}
+	images, err := is.ByGalleryID(gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, ErrNotFound
+	}
+	return &images[0], nil
+}
+
+func (iv *imageValidator) requireGalleryID(image *Image) error {
+	if image.GalleryID == 0 {
+		return ErrGalleryIdRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) requireUserID(image *Image) error {
+	if image.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) requireFilename(image *Image) error {
+	if image.Filename == "" {
+		return ErrFilenameRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameSafe(image *Image) error {
+	if !safeName(image.Filename) {
+		return ErrFilenameInvalid
+	}
+	return nil
+}
+
+func (iv *imageValidator) storageNameSafe(image *Image) error {
+	if image.StorageName == "" || !safeName(image.StorageName) {
+		return ErrStorageNameInvalid
+	}
+	return nil
+}
+
+// safeName is false for anything that could be read as a path, ie
+// contains a slash, a .. sequence or control characters.
+func safeName(name string) bool {
+	if len(name) > 255 || strings.Contains(name, "..") ||
+		strings.ContainsAny(name, `/\`) {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (iv *imageValidator) normalizeText(image *Image) error {
+	image.Caption = strings.TrimSpace(image.Caption)
+	image.AltText = strings.TrimSpace(image.AltText)
+	return nil
+}
+
+func (iv *imageValidator) captionLength(image *Image) error {
+	if utf8.RuneCountInString(image.Caption) > maxCaptionLen {
+		return ErrCaptionTooLong
+	}
+	if utf8.RuneCountInString(image.AltText) > maxAltTextLen {
+		return ErrAltTextTooLong
+	}
+	return nil
+}
+
+func (iv *imageValidator) ByStorageName(galleryID uint, name string) (*Image, error) {
+	image := Image{GalleryID: galleryID, StorageName: name}
+	if err := runImageValFns(&image,
+		iv.requireGalleryID,
+		iv.storageNameSafe); err != nil {
 		return nil, err
 	}
+	return iv.ImageDB.ByStorageName(galleryID, name)
+}
+
+func (iv *imageValidator) Create(image *Image) error {
+	if err := runImageValFns(image,
+		iv.requireGalleryID,
+		iv.requireUserID,
+		iv.requireFilename,
+		iv.filenameSafe,
+		iv.storageNameSafe,
+		iv.contentTypeAllowed,
+		iv.sizeLimit,
+		iv.dimensionLimit,
+		iv.notDuplicate,
+		iv.normalizeText,
+		iv.captionLength); err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(image)
+}
+
+func (iv *imageValidator) Update(image *Image) error {
+	if image.ID == 0 {
+		return ErrIDInvalid
+	}
+	if err := runImageValFns(image,
+		iv.requireGalleryID,
+		iv.requireUserID,
+		iv.requireFilename,
+		iv.normalizeText,
+		iv.captionLength); err != nil {
+		return err
+	}
+	return iv.ImageDB.Update(image)
+}
+
+func (iv *imageValidator) UpdateProcessed(image *Image) error {
+	if image.ID == 0 {
+		return ErrIDInvalid
+	}
+	return iv.ImageDB.UpdateProcessed(image)
+}
+
+func (iv *imageValidator) Delete(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return iv.ImageDB.Delete(id)
+}
+
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.db.Where("id = ?", id)
+	if err := first(db, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ByGalleryID returns the images in a gallery in the order they were put
+// in, with anything that was never moved in the order it was uploaded.
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Where("gallery_id = ?", galleryID).Order("position asc, id asc")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
 
-	ret := make([]Image, len(strings))
-	// Adds leading "/"" to all image file paths
-	for i, imageStr := range strings {
-		ret[i] = Image{
-			Filename:  filepath.Base(imageStr),
-			GalleryID: galleryID,
+func (ig *imageGorm) ByStorageName(galleryID uint, name string) (*Image, error) {
+	var image Image
+	db := ig.db.Where("gallery_id = ? AND storage_name = ?", galleryID, name)
+	if err := first(db, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// BySHA256 finds the image in the gallery with exactly these contents.
+func (ig *imageGorm) BySHA256(galleryID uint, sha256 string) (*Image, error) {
+	var image Image
+	db := ig.db.Where("gallery_id = ? AND sha256 = ?", galleryID, sha256)
+	if err := first(db, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// Create puts new images at the end of the gallery.
+func (ig *imageGorm) Create(image *Image) error {
+	if image.Position == 0 {
+		row := ig.db.Model(&Image{}).Where("gallery_id = ?", image.GalleryID).
+			Select("COALESCE(MAX(position), 0) + 1").Row()
+		if err := row.Scan(&image.Position); err != nil {
+			return err
 		}
 	}
+	return ig.db.Create(image).Error
+}
 
-	return ret, nil
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
 }
 
-func (is *imageService) mkImageDir(galleryID uint) (string, error) {
-	dir := is.imageDir(galleryID)
+func (ig *imageGorm) UpdateProcessed(image *Image) error {
+	return ig.db.Model(&Image{}).Where("id = ?", image.ID).UpdateColumns(map[string]interface{}{
+		"content_type":  image.ContentType,
+		"width":         image.Width,
+		"height":        image.Height,
+		"variants":      image.Variants,
+		"sanitized":     image.Sanitized,
+		"camera_make":   image.CameraMake,
+		"camera_model":  image.CameraModel,
+		"lens_model":    image.LensModel,
+		"exposure_time": image.ExposureTime,
+		"f_number":      image.FNumber,
+		"iso":           image.ISO,
+		"focal_length":  image.FocalLength,
+		"taken_at":      image.TakenAt,
+		"orientation":   image.Orientation,
+		"latitude":      image.Latitude,
+		"longitude":     image.Longitude,
+	}).Error
+}
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return "", err
+func (ig *imageGorm) SetPositions(galleryID uint, ids []uint) error {
+	tx := ig.db.Begin()
+	for n, id := range ids {
+		err := tx.Model(&Image{}).Where("id = ? AND gallery_id = ?", id, galleryID).
+			UpdateColumn("position", n+1).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (ig *imageGorm) Delete(id uint) error {
+	image := Image{Model: gorm.Model{ID: id}}
+	return ig.db.Delete(&image).Error
+}
+
+type imageValFn func(*Image) error
+
+func runImageValFns(image *Image, fns ...imageValFn) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backfill is a one shot import of the files that were uploaded before
+// images had rows of their own. Every object found under galleries/:id
+// that belongs to a live gallery and has no row yet gets one, credited to the
+// gallery owner. It is safe to run more than once and returns how many rows
+// it created.
+func (is *imageService) Backfill() (int, error) {
+	objects, err := is.store.List("galleries/")
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	// backfilled images are already taking up space, so rather than hold
+	// them to quota they're just counted once they're in
+	counted := map[uint]bool{}
+	defer func() {
+		for userID := range counted {
+			if err := is.usage.Recount(userID); err != nil {
+				fmt.Printf("Failed to recount usage for user %d: %s\n", userID, err)
+			}
+		}
+	}()
+	for _, obj := range objects {
+		// keys look like galleries/:id/:filename, anything else isn't an original
+		parts := strings.Split(obj.Key, "/")
+		if len(parts) != 3 {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		gallery, err := is.galleries.ByID(uint(id))
+		if err == ErrNotFound {
+			fmt.Printf("Skipping %s, gallery %d does not exist\n", obj.Key, id)
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+
+		// images in the trash still have their files, they don't need rows
+		exists, err := is.ImageDB.HasStorageName(gallery.ID, parts[2])
+		if err != nil {
+			return created, err
+		}
+		if exists {
+			continue
+		}
+
+		image := Image{
+			GalleryID: gallery.ID,
+			UserID:    gallery.UserID,
+			// nobody is uploading these so the name on disk is all we have
+			Filename:    parts[2],
+			StorageName: parts[2],
+			Size:        obj.Size,
+		}
+		if err := is.sniffStored(&image); err != nil {
+			return created, err
+		}
+		// straight to the db layer since the file is already where it belongs
+		if err := is.ImageDB.Create(&image); err != nil {
+			if isModelError(err) {
+				// old uploads were never checked so some won't pass, leave them be
+				fmt.Printf("Skipping %s: %s\n", obj.Key, err)
+				continue
+			}
+			return created, err
+		}
+		counted[image.UserID] = true
+		if err := is.jobs.Enqueue(JobImageVariants, ImageJob{ImageID: image.ID}); err != nil {
+			fmt.Printf("Failed to queue variants for %s: %s\n", obj.Key, err)
+		}
+		created++
+	}
+	return created, nil
+}
+
+// sniffStored runs sniffImage over an image that is already in storage.
+func (is *imageService) sniffStored(image *Image) error {
+	rc, err := is.store.Get(image.Key())
+	if err != nil {
+		return err
 	}
-	return dir, nil
+	defer rc.Close()
+	err = sniffImage(image, rc)
+	if err == ErrImageCorrupt {
+		// let the validators decide what to do with it
+		return nil
+	}
+	return err
+}
+
+// storageExts maps sniffed content types to the extension we store them with.
+var storageExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
 }
 
-func (is *imageService) imageDir(galleryID uint) string {
-	return filepath.Join("images", "galleries", fmt.Sprintf("%v", galleryID))
+// newStorageName makes up a random name to store an upload under, so two
+// IMG_0001.JPGs never overwrite each other and nothing the uploader sends
+// ends up in a path.
+func newStorageName(contentType string) (string, error) {
+	// 12 bytes is a multiple of 3 so the base64 comes out without padding
+	name, err := rand.String(12)
+	if err != nil {
+		return "", err
+	}
+	return name + storageExts[contentType], nil
 }
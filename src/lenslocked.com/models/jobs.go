@@ -0,0 +1,180 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// JobPending jobs are waiting for RunAt to come around.
+	JobPending = "pending"
+	// JobRunning jobs have been claimed by a worker.
+	JobRunning = "running"
+	// JobDead jobs failed MaxAttempts times and won't be retried. They stick
+	// around so someone can look at LastError and figure out what happened,
+	// but without their payload.
+	JobDead = "dead"
+)
+
+const (
+	defaultJobMaxAttempts = 5
+	// jobLease is how long a worker gets to finish a job before we assume it
+	// crashed and hand the job to someone else.
+	jobLease       = 10 * time.Minute
+	jobBaseBackoff = 30 * time.Second
+	jobMaxBackoff  = time.Hour
+)
+
+var (
+	// ErrJobKindRequired is returned when a job is enqueued without a kind
+	ErrJobKindRequired modelError = "models: job kind is required"
+)
+
+// Job is a unit of work handed off to the background workers, like
+// generating image variants or sending an email. Payload is json so each
+// kind of job can carry whatever it needs.
+type Job struct {
+	gorm.Model
+	Kind        string    `gorm:"not null;index"`
+	Payload     string    `gorm:"type:text"`
+	State       string    `gorm:"not null;index"`
+	Attempts    int       `gorm:"not null"`
+	MaxAttempts int       `gorm:"not null"`
+	RunAt       time.Time `gorm:"not null;index"`
+	LockedAt    *time.Time
+	LastError   string `gorm:"type:text"`
+}
+
+// Decode unmarshals the job's payload into dst.
+func (j *Job) Decode(dst interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), dst)
+}
+
+type JobService interface {
+	// Enqueue json encodes payload and saves it as a pending job of the
+	// given kind that is ready to run right away.
+	Enqueue(kind string, payload interface{}) error
+	// Next claims the next job that is due and marks it running. It returns
+	// ErrNotFound when there is nothing to do.
+	Next() (*Job, error)
+	// Complete removes a job that finished successfully.
+	Complete(job *Job) error
+	// Fail records why the job failed and either schedules a retry with
+	// exponential backoff or, once it is out of attempts, marks it dead.
+	Fail(job *Job, cause error) error
+	// Neither does anything if the job ran past its lease and was claimed
+	// again by Next, it's the newer claim's job now.
+}
+
+type jobGorm struct {
+	db *gorm.DB
+}
+
+func NewJobService(db *gorm.DB) JobService {
+	return &jobGorm{
+		db: db,
+	}
+}
+
+func (jg *jobGorm) Enqueue(kind string, payload interface{}) error {
+	if kind == "" {
+		return ErrJobKindRequired
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	job := Job{
+		Kind:        kind,
+		Payload:     string(b),
+		State:       JobPending,
+		MaxAttempts: defaultJobMaxAttempts,
+		RunAt:       time.Now(),
+	}
+	return jg.db.Create(&job).Error
+}
+
+// Next uses SKIP LOCKED so any number of workers, even across servers, can
+// poll the table without ever being handed the same job. Jobs that have been
+// running longer than their lease are picked up again since the worker that
+// had them most likely died.
+func (jg *jobGorm) Next() (*Job, error) {
+	// LockedAt is how Complete and Fail know the job is still ours, so it
+	// has to match what postgres stores to the microsecond
+	now := time.Now().Truncate(time.Microsecond)
+	tx := jg.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var job Job
+	db := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("(state = ? AND run_at <= ?) OR (state = ? AND locked_at <= ?)",
+			JobPending, now, JobRunning, now.Add(-jobLease)).
+		Order("run_at asc, id asc")
+	if err := first(db, &job); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	job.State = JobRunning
+	job.LockedAt = &now
+	job.Attempts++
+	if err := tx.Save(&job).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (jg *jobGorm) Complete(job *Job) error {
+	return jg.claimed(jg.db.Unscoped(), job).Delete(&Job{}).Error
+}
+
+func (jg *jobGorm) Fail(job *Job, cause error) error {
+	state, payload, runAt := JobPending, job.Payload, time.Now().Add(jobBackoff(job.Attempts))
+	if job.Attempts >= job.MaxAttempts {
+		// payloads can carry things like emailed tokens, the kind and
+		// error are enough to figure out what went wrong
+		state, payload, runAt = JobDead, "", job.RunAt
+	}
+	db := jg.claimed(jg.db.Model(&Job{}), job).Updates(map[string]interface{}{
+		"state":      state,
+		"payload":    payload,
+		"run_at":     runAt,
+		"last_error": cause.Error(),
+		"locked_at":  nil,
+	})
+	if db.Error != nil || db.RowsAffected == 0 {
+		return db.Error
+	}
+	job.State, job.Payload, job.RunAt = state, payload, runAt
+	job.LastError = cause.Error()
+	job.LockedAt = nil
+	return nil
+}
+
+// claimed scopes db to the job as long as it's still running under the
+// claim Next handed out, a job that ran past its lease may have been handed
+// to another worker since.
+func (jg *jobGorm) claimed(db *gorm.DB, job *Job) *gorm.DB {
+	return db.Where("id = ? AND state = ? AND locked_at = ?", job.ID, JobRunning, job.LockedAt)
+}
+
+// jobBackoff doubles the wait after every failed attempt, 30s, 1m, 2m...
+// up to an hour.
+func jobBackoff(attempts int) time.Duration {
+	d := jobBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= jobMaxBackoff {
+			return jobMaxBackoff
+		}
+	}
+	return d
+}
@@ -1,14 +1,21 @@
 package models
 
 import (
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
 	"github.com/jinzhu/gorm"
 )
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery   GalleryService
+	User      UserService
+	Session   SessionService
+	Image     ImageService
+	Job       JobService
+	ShareLink ShareLinkService
+	Upload    UploadSessionService
+	Usage     UsageService
+	db        *gorm.DB
 }
 
 // named function for declaring service configs
@@ -44,23 +51,81 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper, hmacKey string) ServicesConfig {
+func WithUser(pepper, hmacKey, totpKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		cipher, err := hash.NewCipher(totpKey)
+		if err != nil {
+			return err
+		}
+		s.User = NewUserService(s.db, pepper, hmacKey, cipher)
+		return nil
+	}
+}
+
+// WithSession keeps track of which devices users are logged in on, hashing
+// their tokens with hmacKey the same as remember tokens.
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithUsage tracks how much each user is storing, holding them to quota.
+// Galleries and images keep it up to date so it must come before them.
+func WithUsage(quota Quota) ServicesConfig {
+	return func(s *Services) error {
+		s.Usage = NewUsageService(s.db, quota)
+		return nil
+	}
+}
+
+// WithGallery sets up galleries, using the same pepper as user passwords
+// for gallery passwords and hmacKey to sign unlock cookies. WithUsage must
+// come first.
+func WithGallery(pepper, hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Gallery = NewGalleryService(s.db, pepper, hmacKey, s.Usage)
 		return nil
 	}
 }
 
-func WithGallery() ServicesConfig {
+func WithJob() ServicesConfig {
 	return func(s *Services) error {
-		s.Gallery = NewGalleryService(s.db)
+		s.Job = NewJobService(s.db)
 		return nil
 	}
 }
 
-func WithImage() ServicesConfig {
+// WithImage sets up the image service to keep files in the provided store,
+// signing image URLs with signer if it isn't nil. It queues work onto the
+// job service, looks up galleries and counts usage, so WithJob, WithGallery
+// and WithUsage must come first.
+func WithImage(store storage.Store, signer *hash.URLSigner) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService(s.db)
+		s.Image = NewImageService(s.db, store, s.Job, s.Gallery, s.Usage, signer)
+		// deleting a gallery deletes its images too
+		if gs, ok := s.Gallery.(*galleryService); ok {
+			gs.images = s.Image
+		}
+		return nil
+	}
+}
+
+// WithShareLink sets up gallery share links, hashing their tokens with
+// hmacKey the same as remember tokens.
+func WithShareLink(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.ShareLink = NewShareLinkService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithUpload sets up resumable uploads, staging their chunks in store. The
+// finished files go through the image service so WithImage must come first.
+func WithUpload(store storage.Store) ServicesConfig {
+	return func(s *Services) error {
+		s.Upload = NewUploadSessionService(s.db, store, s.Image)
 		return nil
 	}
 }
@@ -73,7 +138,7 @@ func (s *Services) Close() {
 //   1) calls drop table if exists method
 //   2) rebuild the users table using autoMigrate
 func (s *Services) DestructiveReset() error {
-	if err := s.db.DropTableIfExists(&User{}, &Gallery{}, &pwReset{}).Error; err != nil {
+	if err := s.db.DropTableIfExists(&User{}, &Session{}, &Gallery{}, &Image{}, &blob{}, &ShareLink{}, &UploadSession{}, &Usage{}, &Job{}, &pwReset{}, &emailVerification{}, &recoveryCode{}, &unlockAttempt{}).Error; err != nil {
 		return err
 	}
 	return s.AutoMigrate()
@@ -82,8 +147,24 @@ func (s *Services) DestructiveReset() error {
 // Automigrate will attempt to auto migrate the users table - its a prod
 // safe version of destructivereset
 func (s *Services) AutoMigrate() error {
-	if err := s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{}).Error; err != nil {
+	// checked before migrating since it's the migration that adds it
+	grandfatherUsers := s.db.HasTable(&User{}) && !s.db.Dialect().HasColumn("users", "email_verified_at")
+	if err := s.db.AutoMigrate(&User{}, &Session{}, &Gallery{}, &Image{}, &blob{}, &ShareLink{}, &UploadSession{}, &Usage{}, &Job{}, &pwReset{}, &emailVerification{}, &recoveryCode{}, &unlockAttempt{}).Error; err != nil {
+		return err
+	}
+	// images from before we generated storage names are stored under their filename
+	if err := s.db.Model(&Image{}).Where("storage_name IS NULL OR storage_name = ''").
+		UpdateColumn("storage_name", gorm.Expr("filename")).Error; err != nil {
 		return err
 	}
+	// people who signed up before we verified emails would otherwise be
+	// locked out of uploading, so count them as verified from signup. Only
+	// once though, everyone after them has to follow the link.
+	if grandfatherUsers {
+		if err := s.db.Model(&User{}).Where("email_verified_at IS NULL").
+			UpdateColumn("email_verified_at", gorm.Expr("created_at")).Error; err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,339 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// SessionCookie is the name of the cookie holding the session's token.
+	SessionCookie = "session"
+	// SessionDuration is how long someone stays logged in on a device.
+	SessionDuration = 30 * 24 * time.Hour
+	// sessionTouchInterval is how stale LastSeenAt can get before Touch
+	// bothers saving it, so not every request is a write.
+	sessionTouchInterval = 5 * time.Minute
+	// maxUserAgentLen is as much of the User-Agent header as we keep.
+	maxUserAgentLen = 512
+)
+
+// Session is one device a user is logged in on. Like remember tokens only
+// a hash of the token is stored, the token itself lives in the device's
+// cookie.
+type Session struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// UserAgent and IP are from whatever logged in, and IP is kept up to
+	// date by Touch.
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"not null;index"`
+}
+
+// Device is a rough description of what the session is on, eg "Firefox on
+// Windows", worked out from its user agent.
+func (s *Session) Device() string {
+	ua := s.UserAgent
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		// order matters, eg Edge and Opera also claim to be Chrome and
+		// Chrome claims to be Safari
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	system := ""
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			system = o.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	default:
+		return "Unknown device"
+	}
+}
+
+type SessionService interface {
+	// Touch records that the session was just used from ip. It only saves
+	// every few minutes so it can be called on every request. ErrNotFound
+	// means the session was logged out since it was looked up.
+	Touch(session *Session, ip string) error
+	// Cleanup deletes sessions that have expired and returns how many.
+	Cleanup() (int, error)
+	SessionDB
+}
+
+type SessionDB interface {
+	// ByToken finds the session for a cookie's token. Expired sessions are
+	// ErrNotFound.
+	ByToken(token string) (*Session, error)
+	ByID(id uint) (*Session, error)
+	// ByUserID returns the user's sessions that haven't expired, most
+	// recently used first.
+	ByUserID(userID uint) ([]Session, error)
+	// Create starts a session for the user, filling in Token for the cookie.
+	Create(session *Session) error
+	Update(session *Session) error
+	// UpdateLastSeen saves only LastSeenAt and IP, so a session deleted in
+	// the meantime isn't brought back. It returns ErrNotFound if it was.
+	UpdateLastSeen(session *Session) error
+	// Delete logs the session out.
+	Delete(id uint) error
+	// DeleteByUserID logs the user out everywhere except the session with
+	// ID except, which can be 0 to log them out everywhere. It returns how
+	// many sessions it ended.
+	DeleteByUserID(userID, except uint) (int, error)
+	// DeleteExpired deletes sessions past their ExpiresAt, returning how
+	// many.
+	DeleteExpired() (int, error)
+}
+
+func NewSessionService(db *gorm.DB, hmacSecretKey string) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{
+				db: db,
+			},
+			hmac: hash.NewHMAC(hmacSecretKey),
+		},
+	}
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+var _ SessionService = &sessionService{}
+
+func (ss *sessionService) Touch(session *Session, ip string) error {
+	if time.Since(session.LastSeenAt) < sessionTouchInterval && session.IP == ip {
+		return nil
+	}
+	session.LastSeenAt = time.Now()
+	session.IP = ip
+	return ss.UpdateLastSeen(session)
+}
+
+func (ss *sessionService) Cleanup() (int, error) {
+	return ss.DeleteExpired()
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return sv.SessionDB.ByToken(sv.hmac.Hash(token))
+}
+
+func (sv *sessionValidator) ByID(id uint) (*Session, error) {
+	if id == 0 {
+		return nil, ErrIDInvalid
+	}
+	return sv.SessionDB.ByID(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID, except uint) (int, error) {
+	if userID == 0 {
+		return 0, ErrUserIDRequired
+	}
+	return sv.SessionDB.DeleteByUserID(userID, except)
+}
+
+func (sv *sessionValidator) Create(session *Session) error {
+	if err := runSessionValFns(session,
+		sv.requireUserID,
+		sv.setTokenIfUnset,
+		sv.hmacToken,
+		sv.setTimes,
+		sv.trimUserAgent); err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Update(session *Session) error {
+	if err := runSessionValFns(session,
+		sv.requireID,
+		sv.requireUserID,
+		sv.trimUserAgent); err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) requireID(session *Session) error {
+	if session.ID == 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (sv *sessionValidator) requireUserID(session *Session) error {
+	if session.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(session *Session) error {
+	if session.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(session *Session) error {
+	session.TokenHash = sv.hmac.Hash(session.Token)
+	return nil
+}
+
+func (sv *sessionValidator) setTimes(session *Session) error {
+	now := time.Now()
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = now
+	}
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = now.Add(SessionDuration)
+	}
+	return nil
+}
+
+func (sv *sessionValidator) trimUserAgent(session *Session) error {
+	if len(session.UserAgent) > maxUserAgentLen {
+		session.UserAgent = session.UserAgent[:maxUserAgentLen]
+	}
+	return nil
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+var _ SessionDB = &sessionGorm{}
+
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	db := sg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	if err := first(db, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (sg *sessionGorm) ByID(id uint) (*Session, error) {
+	var session Session
+	db := sg.db.Where("id = ? AND expires_at > ?", id, time.Now())
+	if err := first(db, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	db := sg.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc")
+	if err := db.Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+func (sg *sessionGorm) UpdateLastSeen(session *Session) error {
+	db := sg.db.Model(&Session{}).Where("id = ?", session.ID).UpdateColumns(map[string]interface{}{
+		"last_seen_at": session.LastSeenAt,
+		"ip":           session.IP,
+	})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes the row for good, there's nothing worth keeping about a
+// session that has ended.
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{Model: gorm.Model{ID: id}}
+	return sg.db.Unscoped().Delete(&session).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID, except uint) (int, error) {
+	db := sg.db.Unscoped().Where("user_id = ? AND id <> ?", userID, except).Delete(&Session{})
+	return int(db.RowsAffected), db.Error
+}
+
+func (sg *sessionGorm) DeleteExpired() (int, error) {
+	db := sg.db.Unscoped().Where("expires_at <= ?", time.Now()).Delete(&Session{})
+	return int(db.RowsAffected), db.Error
+}
+
+type sessionValFn func(*Session) error
+
+func runSessionValFns(session *Session, fns ...sessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/hash"
+	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrShareLinkExpired is returned when redeeming a link past its ExpiresAt
+	ErrShareLinkExpired modelError = "models: this share link has expired, ask the photographer for a new one"
+	// ErrShareLinkUsedUp is returned when redeeming a link that has had all its views
+	ErrShareLinkUsedUp modelError = "models: this share link has been viewed as many times as it allows, ask the photographer for a new one"
+	// ErrShareLinkExpiryInvalid is returned when creating a link that has already expired
+	ErrShareLinkExpiryInvalid modelError = "models: share links have to expire in the future"
+	// ErrShareLinkMaxViewsInvalid is returned for a negative view limit
+	ErrShareLinkMaxViewsInvalid modelError = "models: the view limit can't be negative"
+	// ErrShareLinkLabelTooLong is returned when the label is over maxShareLinkLabelLen
+	ErrShareLinkLabelTooLong modelError = "models: share link labels must be 100 characters or less"
+)
+
+const maxShareLinkLabelLen = 100
+
+// ShareLink lets someone without an account see a gallery, no matter its
+// visibility, until it expires, runs out of views or is revoked. Like
+// remember tokens only a hash of the token is stored, so the link itself is
+// only ever shown once, right after it is made.
+type ShareLink struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// Label is a note for the owner about who the link was for.
+	Label string
+	// ExpiresAt is when the link stops working, nil means never.
+	ExpiresAt *time.Time
+	// MaxViews is how many times the gallery page can be opened or
+	// downloaded with the link, zero means no limit.
+	MaxViews int `gorm:"not null;default:0"`
+	Views    int `gorm:"not null;default:0"`
+}
+
+func (sl *ShareLink) Expired() bool {
+	return sl.ExpiresAt != nil && !time.Now().Before(*sl.ExpiresAt)
+}
+
+func (sl *ShareLink) UsedUp() bool {
+	return sl.MaxViews > 0 && sl.Views >= sl.MaxViews
+}
+
+// Active is true if the link would still let someone in.
+func (sl *ShareLink) Active() bool {
+	return !sl.Expired() && !sl.UsedUp()
+}
+
+// Status describes the link for the owner's list of links.
+func (sl *ShareLink) Status() string {
+	switch {
+	case sl.Expired():
+		return "Expired"
+	case sl.UsedUp():
+		return "Out of views"
+	case sl.ExpiresAt != nil:
+		return "Expires " + sl.ExpiresAt.Format("Jan 2, 2006 3:04pm")
+	default:
+		return "Never expires"
+	}
+}
+
+// ViewsSummary is eg "3 of 10 views" or "3 views".
+func (sl *ShareLink) ViewsSummary() string {
+	if sl.MaxViews > 0 {
+		return fmt.Sprintf("%d of %d views", sl.Views, sl.MaxViews)
+	}
+	return fmt.Sprintf("%d views", sl.Views)
+}
+
+type ShareLinkService interface {
+	// Redeem looks up the link for token and counts a view against it. It
+	// returns ErrNotFound for unknown and revoked links, and
+	// ErrShareLinkExpired or ErrShareLinkUsedUp if it has stopped working.
+	Redeem(token string) (*ShareLink, error)
+	// Check is true if token is a link to the gallery that still works,
+	// without counting a view. It's what lets the images on a page that was
+	// opened with Redeem load.
+	Check(galleryID uint, token string) bool
+	ShareLinkDB
+}
+
+type ShareLinkDB interface {
+	ByID(id uint) (*ShareLink, error)
+	ByToken(token string) (*ShareLink, error)
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+	// CountView adds a view to the link unless it has run out, returning
+	// ErrShareLinkUsedUp if it has.
+	CountView(id uint) error
+	Create(link *ShareLink) error
+	// Delete revokes the link.
+	Delete(id uint) error
+}
+
+func NewShareLinkService(db *gorm.DB, hmacSecretKey string) ShareLinkService {
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{
+				db: db,
+			},
+			hmac: hash.NewHMAC(hmacSecretKey),
+		},
+	}
+}
+
+type shareLinkService struct {
+	ShareLinkDB
+}
+
+func (ss *shareLinkService) Redeem(token string) (*ShareLink, error) {
+	link, err := ss.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if link.Expired() {
+		return nil, ErrShareLinkExpired
+	}
+	if err := ss.CountView(link.ID); err != nil {
+		return nil, err
+	}
+	link.Views++
+	return link, nil
+}
+
+func (ss *shareLinkService) Check(galleryID uint, token string) bool {
+	link, err := ss.ByToken(token)
+	if err != nil {
+		return false
+	}
+	return link.GalleryID == galleryID && !link.Expired()
+}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+	hmac hash.HMAC
+}
+
+func (sv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	link := ShareLink{Token: token}
+	if err := runShareLinkValFns(&link, sv.requireToken, sv.hmacToken); err != nil {
+		return nil, err
+	}
+	return sv.ShareLinkDB.ByToken(link.TokenHash)
+}
+
+func (sv *shareLinkValidator) Create(link *ShareLink) error {
+	if err := runShareLinkValFns(link,
+		sv.requireGalleryID,
+		sv.normalizeLabel,
+		sv.labelLength,
+		sv.expiryInFuture,
+		sv.maxViewsValid,
+		sv.setTokenIfUnset,
+		sv.hmacToken); err != nil {
+		return err
+	}
+	return sv.ShareLinkDB.Create(link)
+}
+
+func (sv *shareLinkValidator) Delete(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return sv.ShareLinkDB.Delete(id)
+}
+
+func (sv *shareLinkValidator) requireToken(link *ShareLink) error {
+	if link.Token == "" {
+		// nothing could match so there is no sense asking the db
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) requireGalleryID(link *ShareLink) error {
+	if link.GalleryID == 0 {
+		return ErrGalleryIdRequired
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) normalizeLabel(link *ShareLink) error {
+	link.Label = strings.TrimSpace(link.Label)
+	return nil
+}
+
+func (sv *shareLinkValidator) labelLength(link *ShareLink) error {
+	if len([]rune(link.Label)) > maxShareLinkLabelLen {
+		return ErrShareLinkLabelTooLong
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) expiryInFuture(link *ShareLink) error {
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return ErrShareLinkExpiryInvalid
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) maxViewsValid(link *ShareLink) error {
+	if link.MaxViews < 0 {
+		return ErrShareLinkMaxViewsInvalid
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) setTokenIfUnset(link *ShareLink) error {
+	if link.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
+
+func (sv *shareLinkValidator) hmacToken(link *ShareLink) error {
+	if link.Token == "" {
+		return nil
+	}
+	link.TokenHash = sv.hmac.Hash(link.Token)
+	return nil
+}
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+var _ ShareLinkDB = &shareLinkGorm{}
+
+func (sg *shareLinkGorm) ByID(id uint) (*ShareLink, error) {
+	var link ShareLink
+	db := sg.db.Where("id = ?", id)
+	if err := first(db, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ByToken looks the link up by its hashed token.
+func (sg *shareLinkGorm) ByToken(tokenHash string) (*ShareLink, error) {
+	var link ShareLink
+	db := sg.db.Where("token_hash = ?", tokenHash)
+	if err := first(db, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ByGalleryID returns the gallery's links, newest first.
+func (sg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	db := sg.db.Where("gallery_id = ?", galleryID).Order("id desc")
+	if err := db.Find(&links).Error; err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sg *shareLinkGorm) CountView(id uint) error {
+	// checking and counting in one statement means two people opening the
+	// last view at the same time can't both get in
+	db := sg.db.Model(&ShareLink{}).
+		Where("id = ? AND (max_views = 0 OR views < max_views)", id).
+		UpdateColumn("views", gorm.Expr("views + 1"))
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrShareLinkUsedUp
+	}
+	return nil
+}
+
+func (sg *shareLinkGorm) Create(link *ShareLink) error {
+	return sg.db.Create(link).Error
+}
+
+func (sg *shareLinkGorm) Delete(id uint) error {
+	link := ShareLink{Model: gorm.Model{ID: id}}
+	return sg.db.Delete(&link).Error
+}
+
+type shareLinkValFn func(*ShareLink) error
+
+func runShareLinkValFns(link *ShareLink, fns ...shareLinkValFn) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Deleting a gallery or image only moves it to the trash, which is just
+// gorm's soft delete. Everything stays in storage and keeps counting against
+// the owner until it's restored or purged, either by hand from the trash
+// page or by the retention job once it has been there long enough.
+
+type galleryTrashDB interface {
+	// TrashedByUserID returns the user's galleries that are in the trash,
+	// most recently deleted first.
+	TrashedByUserID(userID uint) ([]*Gallery, error)
+	// TrashedByID finds a gallery only if it is in the trash.
+	TrashedByID(id uint) (*Gallery, error)
+	// TrashedBefore returns every gallery put in the trash before t.
+	TrashedBefore(t time.Time) ([]*Gallery, error)
+	// Restore takes the gallery back out of the trash.
+	Restore(id uint) error
+	// Purge removes the gallery's row for good.
+	Purge(id uint) error
+}
+
+type imageTrashDB interface {
+	// TrashedByUserID returns the user's images that were put in the trash
+	// on their own, most recently deleted first. Images in a trashed gallery
+	// go wherever the gallery does so aren't included.
+	TrashedByUserID(userID uint) ([]Image, error)
+	// TrashedByID finds an image only if it is in the trash.
+	TrashedByID(id uint) (*Image, error)
+	// TrashedBefore returns every image put in the trash before t.
+	TrashedBefore(t time.Time) ([]Image, error)
+	// AllByGalleryID is ByGalleryID including the images in the trash.
+	AllByGalleryID(galleryID uint) ([]Image, error)
+	// HasStorageName is true if an image in the gallery, trashed or not, is
+	// stored under name.
+	HasStorageName(galleryID uint, name string) (bool, error)
+	// Restore takes the image back out of the trash.
+	Restore(id uint) error
+	// Purge removes the image's row for good.
+	Purge(id uint) error
+	// Unpurge puts back a row Purge removed, exactly as it was, for when
+	// its files turn out not to be deletable after all.
+	Unpurge(image *Image) error
+}
+
+// Purge deletes a gallery in the trash for good, images and all. If any of
+// the images can't be purged the gallery stays in the trash so the next
+// purge can have another go.
+func (gs *galleryService) Purge(id uint) error {
+	gallery, err := gs.TrashedByID(id)
+	if err != nil {
+		return err
+	}
+	if gs.images != nil {
+		if err := gs.images.PurgeByGallery(gallery.ID); err != nil {
+			return err
+		}
+	}
+	if err := gs.GalleryDB.Purge(gallery.ID); err != nil {
+		return err
+	}
+	if err := gs.usage.Recount(gallery.UserID); err != nil {
+		fmt.Printf("Failed to recount usage for user %d: %s\n", gallery.UserID, err)
+	}
+	return nil
+}
+
+func (gs *galleryService) PurgeTrash(before time.Time) (int, error) {
+	galleries, err := gs.TrashedBefore(before)
+	if err != nil {
+		return 0, err
+	}
+	return purgeEach(len(galleries), func(i int) error {
+		return gs.Purge(galleries[i].ID)
+	})
+}
+
+// Restore takes the image back out of the trash. It is only allowed while
+// the gallery it was in is still around.
+func (is *imageService) Restore(image *Image) error {
+	if _, err := is.galleries.ByID(image.GalleryID); err != nil {
+		return err
+	}
+	return is.ImageDB.Restore(image.ID)
+}
+
+func (is *imageService) TrashedByID(id uint) (*Image, error) {
+	image, err := is.ImageDB.TrashedByID(id)
+	if err != nil {
+		return nil, err
+	}
+	image.signer = is.signer
+	return image, nil
+}
+
+func (is *imageService) PurgeTrash(before time.Time) (int, error) {
+	images, err := is.TrashedBefore(before)
+	if err != nil {
+		return 0, err
+	}
+	return purgeEach(len(images), func(i int) error {
+		return is.Purge(&images[i])
+	})
+}
+
+// purgeEach calls purge for 0 to n-1, carrying on past failures so one bad
+// item can't keep everything else around forever. It returns how many were
+// purged and the first error.
+func purgeEach(n int, purge func(i int) error) (int, error) {
+	purged := 0
+	var first error
+	for i := 0; i < n; i++ {
+		if err := purge(i); err != nil {
+			fmt.Printf("Failed to purge from the trash: %s\n", err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		purged++
+	}
+	return purged, first
+}
+
+func (gv *galleryValidator) TrashedByID(id uint) (*Gallery, error) {
+	if id == 0 {
+		return nil, ErrIDInvalid
+	}
+	return gv.GalleryDB.TrashedByID(id)
+}
+
+func (gv *galleryValidator) Restore(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return gv.GalleryDB.Restore(id)
+}
+
+func (gv *galleryValidator) Purge(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return gv.GalleryDB.Purge(id)
+}
+
+func (gg *galleryGorm) TrashedByUserID(userID uint) ([]*Gallery, error) {
+	var galleries []*Gallery
+	db := gg.db.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at desc")
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) TrashedByID(id uint) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	if err := first(db, &gallery); err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+func (gg *galleryGorm) TrashedBefore(t time.Time) ([]*Gallery, error) {
+	var galleries []*Gallery
+	db := gg.db.Unscoped().Where("deleted_at < ?", t)
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) Restore(id uint) error {
+	return gg.db.Unscoped().Model(&Gallery{}).Where("id = ?", id).
+		UpdateColumn("deleted_at", gorm.Expr("NULL")).Error
+}
+
+func (gg *galleryGorm) Purge(id uint) error {
+	gallery := Gallery{Model: gorm.Model{ID: id}}
+	return gg.db.Unscoped().Delete(&gallery).Error
+}
+
+func (iv *imageValidator) TrashedByID(id uint) (*Image, error) {
+	if id == 0 {
+		return nil, ErrIDInvalid
+	}
+	return iv.ImageDB.TrashedByID(id)
+}
+
+func (iv *imageValidator) Restore(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return iv.ImageDB.Restore(id)
+}
+
+func (iv *imageValidator) Purge(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return iv.ImageDB.Purge(id)
+}
+
+func (ig *imageGorm) TrashedByUserID(userID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Unscoped().Select("images.*").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Where("images.user_id = ? AND images.deleted_at IS NOT NULL", userID).
+		Order("images.deleted_at desc")
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) TrashedByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	if err := first(db, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (ig *imageGorm) TrashedBefore(t time.Time) ([]Image, error) {
+	var images []Image
+	db := ig.db.Unscoped().Where("deleted_at < ?", t)
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) AllByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	db := ig.db.Unscoped().Where("gallery_id = ?", galleryID)
+	if err := db.Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) HasStorageName(galleryID uint, name string) (bool, error) {
+	var count int
+	err := ig.db.Unscoped().Model(&Image{}).Where("gallery_id = ? AND storage_name = ?", galleryID, name).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (ig *imageGorm) Restore(id uint) error {
+	return ig.db.Unscoped().Model(&Image{}).Where("id = ?", id).
+		UpdateColumn("deleted_at", gorm.Expr("NULL")).Error
+}
+
+// Purge removes the row for good, only once its files are gone or about to
+// be, see imageService.Purge.
+func (ig *imageGorm) Purge(id uint) error {
+	image := Image{Model: gorm.Model{ID: id}}
+	return ig.db.Unscoped().Delete(&image).Error
+}
+
+// Unpurge skips the validators on purpose, the row was valid when it was
+// saved and the upload checks would only reject it again, eg as a duplicate.
+func (ig *imageGorm) Unpurge(image *Image) error {
+	return ig.db.Create(image).Error
+}
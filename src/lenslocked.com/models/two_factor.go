@@ -0,0 +1,324 @@
+package models
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/rand"
+	"github.com/eitah/lenslocked/src/lenslocked.com/totp"
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrTOTPCodeInvalid is returned for a code that doesn't match the
+	// user's authenticator app or any of their recovery codes
+	ErrTOTPCodeInvalid modelError = "models: that code isn't right, check your authenticator app and try again"
+	// ErrTOTPLocked is returned after too many wrong codes in a row
+	ErrTOTPLocked modelError = "models: too many wrong codes, wait 15 minutes and try again"
+	// ErrTOTPAlreadyEnabled is returned when turning on two factor twice
+	ErrTOTPAlreadyEnabled modelError = "models: two factor authentication is already turned on"
+	// ErrTOTPNotEnabled is returned when turning off two factor that isn't on
+	ErrTOTPNotEnabled modelError = "models: two factor authentication isn't turned on"
+	// ErrTwoFactorLoginExpired is returned when the code step of logging in
+	// is left too long, or the password changed in the meantime
+	ErrTwoFactorLoginExpired modelError = "models: that took too long, please log in again"
+)
+
+const (
+	// totpIssuer is what authenticator apps list the account under.
+	totpIssuer = "Lenslocked"
+	// maxTOTPFailures is how many codes can be tried without a right one
+	// before two factor is locked for totpLockout. Without it the million
+	// possible codes could be guessed by anyone who has the password.
+	maxTOTPFailures = 5
+	totpLockout     = 15 * time.Minute
+	// TwoFactorLoginDuration is how long someone has to enter their code
+	// after their password.
+	TwoFactorLoginDuration = 10 * time.Minute
+	// recoveryCodeCount is how many recovery codes people get, each good
+	// for one login.
+	recoveryCodeCount = 10
+)
+
+// TwoFactorEnabled is true if logging in needs a code as well as the
+// password.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPSecret != ""
+}
+
+// recoveryCode lets someone who has lost their authenticator app log in
+// once. Like remember tokens only a hash is stored.
+type recoveryCode struct {
+	ID       uint   `gorm:"primary_key"`
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null;unique_index"`
+}
+
+type recoveryCodeDB interface {
+	// Replace swaps all of the user's recovery codes for ones with these
+	// hashes.
+	Replace(userID uint, hashes []string) error
+	// Use deletes the user's code with this hash, returning false if they
+	// didn't have it.
+	Use(userID uint, hash string) (bool, error)
+	Count(userID uint) (int, error)
+}
+
+// totpDB makes the changes checking a code needs in single statements,
+// rather than saving the whole user, so requests racing each other can't
+// get more guesses than they should or use the same code twice.
+type totpDB interface {
+	// CountAttempt counts a code being tried before it's checked, and
+	// returns ErrTOTPLocked instead if the user has had maxTOTPFailures
+	// goes inside totpLockout.
+	CountAttempt(userID uint) error
+	// ResetAttempts is for once a right code has been entered.
+	ResetAttempts(userID uint) error
+	// UseCounter records counter as the last time step a code was used
+	// for, returning false if it, or a later one, already has been.
+	UseCounter(userID uint, counter int64) (bool, error)
+}
+
+func (us *userService) NewTOTPSecret(user *User) (string, error) {
+	if user.TwoFactorEnabled() {
+		return "", ErrTOTPAlreadyEnabled
+	}
+	return totp.NewSecret()
+}
+
+func (us *userService) TOTPURI(user *User, secret string) string {
+	return totp.URI(totpIssuer, user.Email, secret)
+}
+
+func (us *userService) EnableTOTP(user *User, secret, code string) ([]string, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	counter, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+	encrypted, err := us.cipher.Encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := us.newRecoveryCodes(user)
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = encrypted
+	user.TOTPLastCounter = counter
+	user.TOTPFailures = 0
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (us *userService) DisableTOTP(user *User, code string) error {
+	if !user.TwoFactorEnabled() {
+		return ErrTOTPNotEnabled
+	}
+	if err := us.VerifyTOTP(user, code); err != nil {
+		return err
+	}
+	user.TOTPSecret = ""
+	user.TOTPLastCounter = 0
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	return us.recoveryDB.Replace(user.ID, nil)
+}
+
+func (us *userService) VerifyTOTP(user *User, code string) error {
+	if !user.TwoFactorEnabled() {
+		return ErrTOTPNotEnabled
+	}
+	// every try counts until one is right, so guesses sent all at once
+	// can't get in under the limit
+	if err := us.totpDB.CountAttempt(user.ID); err != nil {
+		return err
+	}
+
+	ok, err := us.checkTOTP(user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTOTPCodeInvalid
+	}
+	user.TOTPFailures = 0
+	user.TOTPFailedAt = nil
+	return us.totpDB.ResetAttempts(user.ID)
+}
+
+// checkTOTP is true if code is the current one from the user's app, or one
+// of their recovery codes. Either way it's used up so it can't be used
+// again, even by someone who saw it being typed.
+func (us *userService) checkTOTP(user *User, code string) (bool, error) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != totp.Digits {
+		return us.recoveryDB.Use(user.ID, us.hashRecoveryCode(code))
+	}
+	secret, err := us.cipher.Decrypt(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	counter, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	used, err := us.totpDB.UseCounter(user.ID, counter)
+	if err != nil || !used {
+		return false, err
+	}
+	user.TOTPLastCounter = counter
+	return true, nil
+}
+
+// RecoveryCodesLeft is how many unused recovery codes the user has.
+func (us *userService) RecoveryCodesLeft(user *User) (int, error) {
+	return us.recoveryDB.Count(user.ID)
+}
+
+// newRecoveryCodes replaces the user's recovery codes with new ones and
+// returns them, the only time they're ever seen in full.
+func (us *userService) newRecoveryCodes(user *User) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b, err := rand.Bytes(5)
+		if err != nil {
+			return nil, err
+		}
+		// 10 hex characters split in two so they're easy to read out
+		hex := fmt.Sprintf("%x", b)
+		codes[i] = hex[:5] + "-" + hex[5:]
+		hashes[i] = us.hashRecoveryCode(codes[i])
+	}
+	if err := us.recoveryDB.Replace(user.ID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes the code the same as remember tokens, after
+// ignoring the dash and case so they can be typed however.
+func (us *userService) hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(code, "-", "", -1))
+	return us.hmac.Hash("recovery-code:" + code)
+}
+
+func (us *userService) StartTwoFactorLogin(user *User) string {
+	expires := time.Now().Add(TwoFactorLoginDuration).Unix()
+	return fmt.Sprintf("%d.%d.%s", user.ID, expires, us.twoFactorSignature(user, expires))
+}
+
+func (us *userService) TwoFactorLogin(value string) (*User, error) {
+	parts := strings.SplitN(value, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrTwoFactorLoginExpired
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, ErrTwoFactorLoginExpired
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, ErrTwoFactorLoginExpired
+	}
+	user, err := us.ByID(uint(id))
+	if err == ErrNotFound {
+		return nil, ErrTwoFactorLoginExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	want := us.twoFactorSignature(user, expires)
+	if subtle.ConstantTimeCompare([]byte(want), []byte(parts[2])) != 1 {
+		return nil, ErrTwoFactorLoginExpired
+	}
+	return user, nil
+}
+
+// twoFactorSignature signs the user, expiry and password hash, so a
+// password change part way through means starting again.
+func (us *userService) twoFactorSignature(user *User, expires int64) string {
+	return us.hmac.Hash(fmt.Sprintf("two-factor-login:%d:%d:%s", user.ID, expires, user.PasswordHash))
+}
+
+type totpGorm struct {
+	db *gorm.DB
+}
+
+var _ totpDB = &totpGorm{}
+
+func (tg *totpGorm) CountAttempt(userID uint) error {
+	now := time.Now()
+	cutoff := now.Add(-totpLockout)
+	// the lockout is in the WHERE so checking and counting is one statement,
+	// and a failure from before the window starts the count again
+	db := tg.db.Model(&User{}).
+		Where("id = ? AND (totp_failed_at IS NULL OR totp_failed_at <= ? OR totp_failures < ?)",
+			userID, cutoff, maxTOTPFailures).
+		UpdateColumns(map[string]interface{}{
+			"totp_failures": gorm.Expr(
+				"CASE WHEN totp_failed_at IS NULL OR totp_failed_at <= ? THEN 1 ELSE totp_failures + 1 END", cutoff),
+			"totp_failed_at": now,
+		})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrTOTPLocked
+	}
+	return nil
+}
+
+func (tg *totpGorm) ResetAttempts(userID uint) error {
+	return tg.db.Model(&User{}).Where("id = ?", userID).UpdateColumns(map[string]interface{}{
+		"totp_failures":  0,
+		"totp_failed_at": nil,
+	}).Error
+}
+
+func (tg *totpGorm) UseCounter(userID uint, counter int64) (bool, error) {
+	db := tg.db.Model(&User{}).Where("id = ? AND totp_last_counter < ?", userID, counter).
+		UpdateColumn("totp_last_counter", counter)
+	return db.RowsAffected > 0, db.Error
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+var _ recoveryCodeDB = &recoveryCodeGorm{}
+
+func (rg *recoveryCodeGorm) Replace(userID uint, hashes []string) error {
+	tx := rg.db.Begin()
+	if err := tx.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, hash := range hashes {
+		if err := tx.Create(&recoveryCode{UserID: userID, CodeHash: hash}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (rg *recoveryCodeGorm) Use(userID uint, hash string) (bool, error) {
+	db := rg.db.Where("user_id = ? AND code_hash = ?", userID, hash).Delete(&recoveryCode{})
+	return db.RowsAffected > 0, db.Error
+}
+
+func (rg *recoveryCodeGorm) Count(userID uint) (int, error) {
+	var count int
+	err := rg.db.Model(&recoveryCode{}).Where("user_id = ?", userID).Count(&count).Error
+	return count, err
+}
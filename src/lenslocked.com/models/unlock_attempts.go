@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// maxUnlockAttempts is how many gallery passwords someone can try from
+	// one address before they have to wait out unlockLockout.
+	maxUnlockAttempts = 5
+	unlockLockout     = 15 * time.Minute
+)
+
+// ErrGalleryUnlockThrottled is returned when unlocking a gallery after too
+// many wrong passwords from the same address.
+var ErrGalleryUnlockThrottled modelError = "models: too many wrong passwords, please wait 15 minutes and try again"
+
+// unlockAttempt counts the passwords tried for a gallery from one IP. The
+// count starts over once the last try is unlockLockout old, and the row goes
+// when the right password is entered.
+type unlockAttempt struct {
+	ID        uint      `gorm:"primary_key"`
+	GalleryID uint      `gorm:"not null;unique_index:idx_unlock_attempts_gallery_ip"`
+	IP        string    `gorm:"not null;unique_index:idx_unlock_attempts_gallery_ip"`
+	Attempts  int       `gorm:"not null"`
+	LastAt    time.Time `gorm:"not null;index"`
+}
+
+type unlockAttemptDB interface {
+	// Attempt counts a try from ip before the password is checked, so
+	// guesses racing each other can't all get in under the limit, and
+	// returns how many there have been.
+	Attempt(galleryID uint, ip string) (int, error)
+	// Reset forgets ip's tries for the gallery.
+	Reset(galleryID uint, ip string) error
+}
+
+type unlockAttemptGorm struct {
+	db *gorm.DB
+}
+
+var _ unlockAttemptDB = &unlockAttemptGorm{}
+
+func (ug *unlockAttemptGorm) Attempt(galleryID uint, ip string) (int, error) {
+	now := time.Now()
+	var attempts int
+	err := ug.db.Raw(`INSERT INTO unlock_attempts (gallery_id, ip, attempts, last_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT (gallery_id, ip) DO UPDATE SET
+			attempts = CASE WHEN unlock_attempts.last_at <= ? THEN 1 ELSE unlock_attempts.attempts + 1 END,
+			last_at = EXCLUDED.last_at
+		RETURNING attempts`, galleryID, ip, now, now.Add(-unlockLockout)).Row().Scan(&attempts)
+	return attempts, err
+}
+
+func (ug *unlockAttemptGorm) Reset(galleryID uint, ip string) error {
+	return ug.db.Where("gallery_id = ? AND ip = ?", galleryID, ip).Delete(&unlockAttempt{}).Error
+}
@@ -0,0 +1,466 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eitah/lenslocked/src/lenslocked.com/storage"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// MaxUploadChunk is the most one chunk of a resumable upload can be.
+	MaxUploadChunk = 8 << 20 // 8 mb
+	// maxOpenUploads is how many resumable uploads a user can have going at
+	// once, so nobody can fill up the staging area.
+	maxOpenUploads = 100
+	// UploadSessionTTL is how long an upload can sit without a new chunk
+	// before it counts as abandoned and gets cleaned up.
+	UploadSessionTTL = 24 * time.Hour
+)
+
+var (
+	// ErrUploadSizeInvalid is returned when starting an upload that is empty
+	// or bigger than an image is allowed to be
+	ErrUploadSizeInvalid modelError = "models: uploads must be between 1 byte and 25MB"
+	// ErrUploadChecksumInvalid is returned when a chunk's checksum isn't a
+	// hex SHA-256
+	ErrUploadChecksumInvalid modelError = "models: checksums must be a hex encoded SHA-256"
+	// ErrUploadChecksumMismatch is returned when what arrived doesn't match
+	// the checksum sent with it
+	ErrUploadChecksumMismatch modelError = "models: the data received doesn't match its checksum, please send it again"
+	// ErrUploadOffsetMismatch is returned for a chunk that doesn't start
+	// where the last one left off
+	ErrUploadOffsetMismatch modelError = "models: that chunk doesn't start where the upload left off"
+	// ErrUploadChunkTooLarge is returned for chunks over MaxUploadChunk or
+	// that would go past the size the upload was started with
+	ErrUploadChunkTooLarge modelError = "models: chunks can be at most 8MB and can't go past the end of the file"
+	// ErrUploadIncomplete is returned when finishing an upload that is
+	// missing some of its data
+	ErrUploadIncomplete modelError = "models: this upload hasn't received all of its data yet"
+	// ErrTooManyUploads is returned when a user already has maxOpenUploads going
+	ErrTooManyUploads modelError = "models: you have too many uploads in progress, finish or cancel some first"
+)
+
+// UploadSession is an image being uploaded a chunk at a time so a dropped
+// connection only loses the chunk that was in flight. Chunks are staged in
+// storage under StagingPrefix until the whole file has arrived, when it is
+// handed to ImageService.Create like any other upload.
+type UploadSession struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	GalleryID uint   `gorm:"not null"`
+	Filename  string `gorm:"not null"`
+	// Size is how big the client said the file is.
+	Size int64 `gorm:"not null"`
+	// SHA256 is the hex checksum of the whole file, optional.
+	SHA256 string
+	// Received is how many bytes have arrived, ie where the next chunk
+	// starts.
+	Received int64 `gorm:"not null;default:0"`
+}
+
+// StagingPrefix is where the upload's chunks are kept until it's finished.
+func (u *UploadSession) StagingPrefix() string {
+	return storage.JoinKey("uploads", fmt.Sprintf("%v", u.ID)) + "/"
+}
+
+// chunkKey is where the chunk starting at offset is staged. Offsets are
+// padded so the keys sort in the order the chunks go in.
+func (u *UploadSession) chunkKey(offset int64) string {
+	return u.StagingPrefix() + fmt.Sprintf("%012d", offset)
+}
+
+func (u *UploadSession) Complete() bool {
+	return u.Received == u.Size
+}
+
+type UploadSessionService interface {
+	// Start validates and records a new upload.
+	Start(upload *UploadSession) error
+	// Append stages a chunk of the file. offset has to be where the last
+	// chunk ended and sum the chunk's hex SHA-256, which is checked against
+	// what actually arrived before anything is kept.
+	Append(upload *UploadSession, offset int64, sum string, r io.Reader) error
+	// Finish adds the fully received file to the gallery and cleans up
+	// after the upload. If the file can't go in for now, eg the owner is
+	// out of space, the upload is kept so Finish can be called again.
+	Finish(upload *UploadSession) (*Image, error)
+	// Cancel throws the upload and anything it received away.
+	Cancel(upload *UploadSession) error
+	// Cleanup cancels uploads that haven't had a chunk in UploadSessionTTL
+	// and returns how many it removed.
+	Cleanup() (int, error)
+	UploadSessionDB
+}
+
+type UploadSessionDB interface {
+	ByID(id uint) (*UploadSession, error)
+	// CountByUserID is how many uploads the user has in progress.
+	CountByUserID(userID uint) (int, error)
+	// Stale returns uploads that haven't been touched since before.
+	Stale(before time.Time) ([]UploadSession, error)
+	Create(upload *UploadSession) error
+	// Advance moves the upload's Received on by n, but only if it is still
+	// at offset. It returns ErrUploadOffsetMismatch if it isn't, so two
+	// copies of the same chunk racing each other can't both count.
+	Advance(upload *UploadSession, offset, n int64) error
+	Delete(id uint) error
+}
+
+// NewUploadSessionService stages chunks in store and creates the finished
+// images with images.
+func NewUploadSessionService(db *gorm.DB, store storage.Store, images ImageService) UploadSessionService {
+	return &uploadSessionService{
+		UploadSessionDB: &uploadSessionValidator{
+			UploadSessionDB: &uploadSessionGorm{
+				db: db,
+			},
+		},
+		store:  store,
+		images: images,
+	}
+}
+
+type uploadSessionService struct {
+	UploadSessionDB
+	store  storage.Store
+	images ImageService
+}
+
+func (us *uploadSessionService) Start(upload *UploadSession) error {
+	open, err := us.CountByUserID(upload.UserID)
+	if err != nil {
+		return err
+	}
+	if open >= maxOpenUploads {
+		return ErrTooManyUploads
+	}
+	return us.Create(upload)
+}
+
+func (us *uploadSessionService) Append(upload *UploadSession, offset int64, sum string, r io.Reader) error {
+	sum = strings.ToLower(sum)
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return ErrUploadChecksumInvalid
+	}
+	if offset != upload.Received {
+		return ErrUploadOffsetMismatch
+	}
+
+	// spool the chunk so the checksum can be checked before it goes
+	// anywhere, it's small enough to just keep in memory
+	limit := upload.Size - offset
+	if limit > MaxUploadChunk {
+		limit = MaxUploadChunk
+	}
+	h := sha256.New()
+	var buf bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(&buf, h), io.LimitReader(r, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return ErrUploadChunkTooLarge
+	}
+	if hex.EncodeToString(h.Sum(nil)) != sum {
+		return ErrUploadChecksumMismatch
+	}
+	if n == 0 {
+		return nil
+	}
+
+	key := upload.chunkKey(offset)
+	if _, err := us.store.Put(key, &buf); err != nil {
+		return err
+	}
+	if err := us.Advance(upload, offset, n); err != nil {
+		// another copy of this chunk got there first and wrote the same
+		// key, so leave it be. A client racing itself with different data
+		// for the same offset only spoils its own upload, which Finish
+		// catches if it sent a checksum for the whole file. Anything else
+		// means ours is the only copy and it isn't counted.
+		if err != ErrUploadOffsetMismatch {
+			us.store.Delete(key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (us *uploadSessionService) Finish(upload *UploadSession) (*Image, error) {
+	if !upload.Complete() {
+		return nil, ErrUploadIncomplete
+	}
+	chunks, err := us.chunks(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	image := Image{
+		GalleryID: upload.GalleryID,
+		UserID:    upload.UserID,
+		Filename:  upload.Filename,
+	}
+	r := &chunkReader{store: us.store, keys: chunks}
+	err = us.images.Create(&image, r)
+	r.Close()
+	if fileRejected(err) {
+		// sending the file again won't change that, so there's no point
+		// keeping the chunks around
+		if err := us.Cancel(upload); err != nil {
+			fmt.Printf("Failed to clean up upload %d: %s\n", upload.ID, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if upload.SHA256 != "" && !strings.EqualFold(upload.SHA256, image.SHA256) {
+		// every chunk checked out so this is a client that hashed the
+		// wrong file, don't keep what it sent
+		if err := us.images.Purge(&image); err != nil {
+			return nil, err
+		}
+		return nil, ErrUploadChecksumMismatch
+	}
+
+	if err := us.Cancel(upload); err != nil {
+		// the image is in, worst case Cleanup gets the rest later
+		fmt.Printf("Failed to clean up upload %d: %s\n", upload.ID, err)
+	}
+	return &image, nil
+}
+
+// fileRejected is true for the errors about the file itself. Anything else,
+// like running out of quota, can go away, so the upload is kept for Finish
+// to be tried again until Cleanup gets it.
+func fileRejected(err error) bool {
+	switch err {
+	case ErrImageTypeInvalid, ErrImageHEIC, ErrImageTooLarge, ErrImageDimensions,
+		ErrImageCorrupt, ErrFilenameRequired, ErrFilenameInvalid:
+		return true
+	}
+	return false
+}
+
+// chunks lists the upload's staged chunks in order, making sure they line
+// up end to end and cover the whole file.
+func (us *uploadSessionService) chunks(upload *UploadSession) ([]string, error) {
+	objects, err := us.store.List(upload.StagingPrefix())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	var keys []string
+	var offset int64
+	for _, obj := range objects {
+		if obj.Key != upload.chunkKey(offset) {
+			return nil, ErrUploadIncomplete
+		}
+		keys = append(keys, obj.Key)
+		offset += obj.Size
+	}
+	if offset != upload.Size {
+		return nil, ErrUploadIncomplete
+	}
+	return keys, nil
+}
+
+func (us *uploadSessionService) Cancel(upload *UploadSession) error {
+	objects, err := us.store.List(upload.StagingPrefix())
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := us.store.Delete(obj.Key); err != nil {
+			return err
+		}
+	}
+	return us.Delete(upload.ID)
+}
+
+func (us *uploadSessionService) Cleanup() (int, error) {
+	uploads, err := us.Stale(time.Now().Add(-UploadSessionTTL))
+	if err != nil {
+		return 0, err
+	}
+	for i, upload := range uploads {
+		if err := us.Cancel(&upload); err != nil {
+			return i, err
+		}
+	}
+	return len(uploads), nil
+}
+
+// chunkReader reads the staged chunks one after another as if they were
+// one file, only ever having one of them open.
+type chunkReader struct {
+	store storage.Store
+	keys  []string
+	cur   io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.cur == nil {
+			if len(cr.keys) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := cr.store.Get(cr.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			cr.cur, cr.keys = rc, cr.keys[1:]
+		}
+		n, err := cr.cur.Read(p)
+		if err == io.EOF {
+			cr.cur.Close()
+			cr.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.cur == nil {
+		return nil
+	}
+	return cr.cur.Close()
+}
+
+type uploadSessionValidator struct {
+	UploadSessionDB
+}
+
+func (uv *uploadSessionValidator) Create(upload *UploadSession) error {
+	if err := runUploadSessionValFns(upload,
+		uv.requireIDs,
+		uv.filenameSafe,
+		uv.sizeValid,
+		uv.checksumValid); err != nil {
+		return err
+	}
+	return uv.UploadSessionDB.Create(upload)
+}
+
+func (uv *uploadSessionValidator) Delete(id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	return uv.UploadSessionDB.Delete(id)
+}
+
+func (uv *uploadSessionValidator) requireIDs(upload *UploadSession) error {
+	if upload.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	if upload.GalleryID == 0 {
+		return ErrGalleryIdRequired
+	}
+	return nil
+}
+
+func (uv *uploadSessionValidator) filenameSafe(upload *UploadSession) error {
+	if upload.Filename == "" {
+		return ErrFilenameRequired
+	}
+	if !safeName(upload.Filename) {
+		return ErrFilenameInvalid
+	}
+	return nil
+}
+
+func (uv *uploadSessionValidator) sizeValid(upload *UploadSession) error {
+	if upload.Size <= 0 || upload.Size > maxImageBytes {
+		return ErrUploadSizeInvalid
+	}
+	return nil
+}
+
+func (uv *uploadSessionValidator) checksumValid(upload *UploadSession) error {
+	if upload.SHA256 == "" {
+		return nil
+	}
+	upload.SHA256 = strings.ToLower(upload.SHA256)
+	if _, err := hex.DecodeString(upload.SHA256); err != nil || len(upload.SHA256) != sha256.Size*2 {
+		return ErrUploadChecksumInvalid
+	}
+	return nil
+}
+
+type uploadSessionGorm struct {
+	db *gorm.DB
+}
+
+var _ UploadSessionDB = &uploadSessionGorm{}
+
+func (ug *uploadSessionGorm) ByID(id uint) (*UploadSession, error) {
+	var upload UploadSession
+	db := ug.db.Where("id = ?", id)
+	if err := first(db, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (ug *uploadSessionGorm) CountByUserID(userID uint) (int, error) {
+	var n int
+	err := ug.db.Model(&UploadSession{}).Where("user_id = ?", userID).Count(&n).Error
+	return n, err
+}
+
+func (ug *uploadSessionGorm) Stale(before time.Time) ([]UploadSession, error) {
+	var uploads []UploadSession
+	err := ug.db.Where("updated_at < ?", before).Find(&uploads).Error
+	return uploads, err
+}
+
+func (ug *uploadSessionGorm) Create(upload *UploadSession) error {
+	return ug.db.Create(upload).Error
+}
+
+func (ug *uploadSessionGorm) Advance(upload *UploadSession, offset, n int64) error {
+	now := time.Now()
+	db := ug.db.Model(&UploadSession{}).
+		Where("id = ? AND received = ?", upload.ID, offset).
+		UpdateColumns(map[string]interface{}{
+			"received":   gorm.Expr("received + ?", n),
+			"updated_at": now,
+		})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrUploadOffsetMismatch
+	}
+	upload.Received = offset + n
+	upload.UpdatedAt = now
+	return nil
+}
+
+// Delete removes the row for good, there's nothing worth keeping about an
+// upload once it's done.
+func (ug *uploadSessionGorm) Delete(id uint) error {
+	return ug.db.Unscoped().Delete(&UploadSession{}, "id = ?", id).Error
+}
+
+type uploadSessionValFn func(*UploadSession) error
+
+func runUploadSessionValFns(upload *UploadSession, fns ...uploadSessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
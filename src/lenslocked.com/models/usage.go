@@ -0,0 +1,172 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrQuotaBytesExceeded is returned when an upload would take a user
+	// past their storage limit
+	ErrQuotaBytesExceeded modelError = "models: you're out of storage space, delete some photos to make room for this one"
+	// ErrQuotaImagesExceeded is returned when a user already has as many
+	// photos as they're allowed
+	ErrQuotaImagesExceeded modelError = "models: you've reached the most photos your account can hold, delete some to make room for this one"
+)
+
+// Quota is how much a user can keep. Zero for either means no limit.
+type Quota struct {
+	MaxBytes  int64
+	MaxImages int
+}
+
+// Usage is how much a user is storing. Bytes counts the originals of
+// every image they have, so a photo in two galleries counts twice even
+// though we only store it once. Anything in the trash still counts since
+// it's still stored, until it's purged.
+type Usage struct {
+	UserID uint  `gorm:"primary_key;auto_increment:false"`
+	Bytes  int64 `gorm:"not null;default:0"`
+	Images int   `gorm:"not null;default:0"`
+	// Quota is filled in by UsageService so pages can show how close the
+	// user is to their limits.
+	Quota Quota `gorm:"-"`
+}
+
+// UsedSize is Bytes for people, eg "1.2 GB".
+func (u *Usage) UsedSize() string {
+	return humanBytes(u.Bytes)
+}
+
+func (u *Usage) MaxSize() string {
+	return humanBytes(u.Quota.MaxBytes)
+}
+
+// Percent is how much of the storage limit is used, or of the image limit
+// if that's closer to running out.
+func (u *Usage) Percent() int {
+	var pct float64
+	if u.Quota.MaxBytes > 0 {
+		pct = float64(u.Bytes) / float64(u.Quota.MaxBytes) * 100
+	}
+	if u.Quota.MaxImages > 0 {
+		if p := float64(u.Images) / float64(u.Quota.MaxImages) * 100; p > pct {
+			pct = p
+		}
+	}
+	if pct > 100 {
+		return 100
+	}
+	return int(pct)
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type UsageService interface {
+	// ByUserID returns what the user is using along with their quota.
+	ByUserID(userID uint) (*Usage, error)
+	// Reserve counts a new image of size bytes against the user. It returns
+	// ErrQuotaBytesExceeded or ErrQuotaImagesExceeded instead if that would
+	// take them over their quota.
+	Reserve(userID uint, size int64) error
+	// Release takes an image of size bytes back off the user's usage.
+	Release(userID uint, size int64) error
+	// Recount works the user's usage out from scratch from their images,
+	// for when lots change at once like when a gallery is purged.
+	Recount(userID uint) error
+}
+
+// NewUsageService tracks usage in db, holding every user to quota.
+func NewUsageService(db *gorm.DB, quota Quota) UsageService {
+	return &usageGorm{
+		db:    db,
+		quota: quota,
+	}
+}
+
+type usageGorm struct {
+	db    *gorm.DB
+	quota Quota
+}
+
+var _ UsageService = &usageGorm{}
+
+func (ug *usageGorm) ByUserID(userID uint) (*Usage, error) {
+	var usage Usage
+	err := first(ug.db.Where("user_id = ?", userID), &usage)
+	if err == ErrNotFound {
+		if err = ug.ensure(userID); err == nil {
+			err = first(ug.db.Where("user_id = ?", userID), &usage)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	usage.Quota = ug.quota
+	return &usage, nil
+}
+
+func (ug *usageGorm) Reserve(userID uint, size int64) error {
+	ok, err := ug.reserve(userID, size)
+	if err != nil || ok {
+		return err
+	}
+	// either they're over or this is the first time we've counted for
+	// them, make sure it's the first and try again
+	usage, err := ug.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+	if ok, err = ug.reserve(userID, size); err != nil || ok {
+		return err
+	}
+	if ug.quota.MaxImages > 0 && usage.Images+1 > ug.quota.MaxImages {
+		return ErrQuotaImagesExceeded
+	}
+	return ErrQuotaBytesExceeded
+}
+
+// reserve counts the image if the user has a usages row and it fits their
+// quota, checking and counting in one statement so two uploads at once
+// can't both squeeze into the last bit of space.
+func (ug *usageGorm) reserve(userID uint, size int64) (bool, error) {
+	q := ug.quota
+	db := ug.db.Exec(`UPDATE usages SET bytes = bytes + ?, images = images + 1
+		WHERE user_id = ? AND (? = 0 OR bytes + ? <= ?) AND (? = 0 OR images + 1 <= ?)`,
+		size, userID, q.MaxBytes, size, q.MaxBytes, q.MaxImages, q.MaxImages)
+	return db.RowsAffected > 0, db.Error
+}
+
+func (ug *usageGorm) Release(userID uint, size int64) error {
+	return ug.db.Exec(`UPDATE usages SET bytes = GREATEST(bytes - ?, 0), images = GREATEST(images - 1, 0)
+		WHERE user_id = ?`, size, userID).Error
+}
+
+// usageQuery adds up the user's images, including the ones in the trash.
+const usageQuery = `SELECT CAST(? AS integer), COALESCE(SUM(size), 0), COUNT(id)
+	FROM images WHERE user_id = ?`
+
+func (ug *usageGorm) Recount(userID uint) error {
+	return ug.db.Exec(`INSERT INTO usages (user_id, bytes, images) `+usageQuery+`
+		ON CONFLICT (user_id) DO UPDATE SET bytes = EXCLUDED.bytes, images = EXCLUDED.images`,
+		userID, userID).Error
+}
+
+// ensure makes sure the user has a usages row, counting up whatever they
+// already had if this is the first time we've looked.
+func (ug *usageGorm) ensure(userID uint) error {
+	return ug.db.Exec(`INSERT INTO usages (user_id, bytes, images) `+usageQuery+`
+		ON CONFLICT (user_id) DO NOTHING`, userID, userID).Error
+}
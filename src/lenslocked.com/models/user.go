@@ -63,6 +63,18 @@ type User struct {
 	PasswordHash string `gorm:"not null"`
 	Remember     string `gorm:"-"`
 	RememberHash string `gorm:"not null;unique_index"`
+	// EmailVerifiedAt is when they proved Email is theirs, nil until then.
+	EmailVerifiedAt *time.Time
+
+	// TOTPSecret is the secret for two factor codes, encrypted since unlike
+	// passwords we need it back. Empty unless two factor is turned on, see
+	// two_factor.go
+	TOTPSecret string
+	// TOTPLastCounter is the step of the last code used so it can't be
+	// used twice.
+	TOTPLastCounter int64
+	TOTPFailures    int
+	TOTPFailedAt    *time.Time
 }
 
 type UserService interface {
@@ -79,13 +91,57 @@ type UserService interface {
 	// password. If the token has expired or if it is invalid for any other reason, the
 	// ErrTokenInvalid error will be returned.
 	CompleteReset(token, newPw string) (*User, error)
+	// InitiateVerification starts verifying the user's email address,
+	// returning the token to email them.
+	InitiateVerification(user *User) (string, error)
+	// CompleteVerification marks the address the token was sent to as
+	// verified, returning ErrVerifyTokenInvalid if it's no good.
+	CompleteVerification(token string) (*User, error)
+	// InitiateEmailChange checks password and that email is free, then
+	// starts verifying it. It returns the token to email to the new address
+	// and the address normalized. The user's email only changes once
+	// CompleteVerification is called with the token.
+	InitiateEmailChange(user *User, email, password string) (token, newEmail string, err error)
+	// PendingEmail is the address the user is changing to, if any.
+	PendingEmail(user *User) (string, error)
+	// ChangePassword sets the user's password to newPw if current is right.
+	ChangePassword(user *User, current, newPw string) error
+
+	// NewTOTPSecret makes a secret for the user to add to their
+	// authenticator app. Nothing is saved until EnableTOTP.
+	NewTOTPSecret(user *User) (string, error)
+	// TOTPURI is the otpauth URI for secret to show as a QR code.
+	TOTPURI(user *User, secret string) string
+	// EnableTOTP turns on two factor once code shows the user's app has the
+	// secret. It returns their recovery codes, which are never available
+	// again.
+	EnableTOTP(user *User, secret, code string) ([]string, error)
+	// DisableTOTP turns two factor off again. The code can be from their app
+	// or a recovery code.
+	DisableTOTP(user *User, code string) error
+	// VerifyTOTP checks a code from the user's app or one of their recovery
+	// codes. Too many wrong codes in a row returns ErrTOTPLocked for a while.
+	VerifyTOTP(user *User, code string) error
+	RecoveryCodesLeft(user *User) (int, error)
+	// StartTwoFactorLogin is called once the password checks out for a user
+	// with two factor on. It returns a value for a short lived cookie that
+	// TwoFactorLogin turns back into the user.
+	StartTwoFactorLogin(user *User) string
+	TwoFactorLogin(value string) (*User, error)
 	UserDB
 }
 
 type userService struct {
 	UserDB
-	pepper    string
-	pwResetDB pwResetDB
+	// validator is UserDB as well, kept for checking fields before saving
+	validator  *userValidator
+	pepper     string
+	pwResetDB  pwResetDB
+	verifyDB   emailVerificationDB
+	hmac       hash.HMAC
+	cipher     *hash.Cipher
+	recoveryDB recoveryCodeDB
+	totpDB     totpDB
 }
 
 type userValidator struct {
@@ -117,16 +173,23 @@ type UserDB interface {
 	Delete(id uint) error
 }
 
-func NewUserService(db *gorm.DB, pepper, hmacSecretKey string) UserService {
+// NewUserService uses cipher to encrypt two factor secrets.
+func NewUserService(db *gorm.DB, pepper, hmacSecretKey string, cipher *hash.Cipher) UserService {
 	ug := &userGorm{
 		db: db,
 	}
 	hmac := hash.NewHMAC(hmacSecretKey)
 	uv := NewUserValidator(ug, hmac, pepper)
 	return &userService{
-		UserDB:    uv,
-		pepper:    pepper,
-		pwResetDB: NewPwResetValidator(&pwResetGorm{db: db}, hmac),
+		UserDB:     uv,
+		validator:  uv,
+		pepper:     pepper,
+		pwResetDB:  NewPwResetValidator(&pwResetGorm{db: db}, hmac),
+		verifyDB:   newEmailVerificationValidator(&emailVerificationGorm{db: db}, hmac),
+		hmac:       hmac,
+		cipher:     cipher,
+		recoveryDB: &recoveryCodeGorm{db: db},
+		totpDB:     &totpGorm{db: db},
 	}
 }
 
@@ -144,17 +207,34 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := us.checkPassword(foundUser, password); err != nil {
+		return nil, err
+	}
+	return foundUser, nil
+}
 
+// checkPassword returns ErrPasswordIncorrect unless password is the user's.
+func (us *userService) checkPassword(user *User, password string) error {
 	pepperedPWBytes := []byte(password + us.pepper)
-	if err := bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), pepperedPWBytes); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), pepperedPWBytes); err != nil {
 		if err == bcrypt.ErrMismatchedHashAndPassword {
-			return nil, ErrPasswordIncorrect
+			return ErrPasswordIncorrect
 		} else {
-			return nil, err
+			return err
 		}
 	}
+	return nil
+}
 
-	return foundUser, nil
+func (us *userService) ChangePassword(user *User, current, newPw string) error {
+	if err := us.checkPassword(user, current); err != nil {
+		return err
+	}
+	if newPw == "" {
+		return ErrPasswordRequired
+	}
+	user.Password = newPw
+	return us.Update(user)
 }
 
 func (uv *userValidator) normalizeEmail(user *User) error {
@@ -486,6 +566,11 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 		return nil, err
 	}
 	user.Password = newPw
+	if !user.EmailVerified() {
+		// the reset link went to their email, which proves it's theirs
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
 	err = us.Update(user)
 	if err != nil {
 		return nil, err
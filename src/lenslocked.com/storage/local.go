@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewLocal returns a Store that keeps objects on the local disk under dir.
+func NewLocal(dir string) *Local {
+	return &Local{
+		dir: dir,
+	}
+}
+
+// Local is the original disk backed store. It's what we use in dev, but
+// keep in mind that heroku's disk is wiped on every deploy.
+type Local struct {
+	dir string
+}
+
+var _ Store = &Local{}
+
+// Dir is the directory objects are written to.
+func (l *Local) Dir() string {
+	return l.dir
+}
+
+func (l *Local) Put(key string, r io.Reader) (int64, error) {
+	if !ValidKey(key) {
+		return 0, ErrInvalidKey
+	}
+	path := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	// We write to a temp file first so a half written upload never shows up
+	// under the real name, then move it into place once everything made it.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	f, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *Local) Open(key string) (File, Object, error) {
+	if !ValidKey(key) {
+		return nil, Object{}, ErrInvalidKey
+	}
+	f, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, Object{}, ErrNotExist
+	}
+	if err != nil {
+		return nil, Object{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Object{}, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, Object{}, ErrNotExist
+	}
+	return f, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) Delete(key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	p := l.path(key)
+	err := os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l.removeEmptyParents(p)
+	return nil
+}
+
+// removeEmptyParents removes the directories above p that deleting it left
+// empty, so eg a deleted gallery doesn't leave galleries/:id behind. It
+// stops at the first one that still has something in it.
+func (l *Local) removeEmptyParents(p string) {
+	root := filepath.Clean(l.dir)
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// PruneEmpty removes every empty directory under prefix, for cleaning up
+// after files that were deleted before Delete did it, and returns the keys
+// of the ones it removed.
+func (l *Local) PruneEmpty(prefix string) ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(l.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || path == l.dir {
+			return nil
+		}
+		rel, err := filepath.Rel(l.dir, path)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(filepath.ToSlash(rel)+"/", prefix) {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	// Walk goes parents first, so backwards means children go before the
+	// parent that might be left empty by them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil {
+			// not empty
+			continue
+		}
+		rel, _ := filepath.Rel(l.dir, dirs[i])
+		removed = append(removed, filepath.ToSlash(rel)+"/")
+	}
+	return removed, nil
+}
+
+func (l *Local) List(prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.Walk(l.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// skip directories and any temp files left over from a crashed upload
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *Local) path(key string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(key))
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotExist is returned when a key has nothing stored under it.
+	ErrNotExist = errors.New("storage: object does not exist")
+	// ErrInvalidKey is returned for keys that could escape wherever the
+	// store keeps its objects, see ValidKey.
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// Store is anywhere we can keep the bytes for our images. Keys are slash
+// separated paths like "galleries/3/beach.jpg" and every backend lays them
+// out the same way so we can switch backends without rewriting the db.
+type Store interface {
+	// Put saves everything read from r under key, replacing whatever was
+	// there before, and returns the number of bytes written.
+	Put(key string, r io.Reader) (int64, error)
+	// Get opens the object stored under key. Callers must close it.
+	Get(key string) (io.ReadCloser, error)
+	// Open is Get for when the object needs reading from anywhere, like
+	// when answering a Range request. It also describes the object.
+	Open(key string) (File, Object, error)
+	// Delete removes key. Deleting a key that doesn't exist isn't an error.
+	Delete(key string) error
+	// List returns every object whose key starts with prefix.
+	List(prefix string) ([]Object, error)
+}
+
+// Object describes something that has been stored.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// File is an open object that can be read from any offset. Callers must
+// close it.
+type File interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// JoinKey builds a key out of path segments, eg JoinKey("galleries", "3",
+// "beach.jpg") is "galleries/3/beach.jpg".
+func JoinKey(parts ...string) string {
+	return strings.Join(parts, "/")
+}
+
+// ValidKey is false for keys that are empty, absolute, contain backslashes
+// or have empty, "." or ".." segments. Every backend checks keys with it
+// before touching anything.
+func ValidKey(key string) bool {
+	if key == "" || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
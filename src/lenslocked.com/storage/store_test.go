@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The S3 tests run against MinIO, or anything else that speaks the S3 api,
+// when S3_TEST_ENDPOINT is set and are skipped otherwise, see the README.
+// The bucket is created if it doesn't exist, and everything written is
+// under a prefix unique to the run which is deleted afterwards.
+
+func TestLocal(t *testing.T) {
+	testStore(t, NewLocal(t.TempDir()), "")
+}
+
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	s := NewS3(S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_TEST_REGION"),
+		Bucket:    envOr("S3_TEST_BUCKET", "lenslocked-test"),
+		AccessKey: envOr("S3_TEST_ACCESS_KEY", "minioadmin"),
+		SecretKey: envOr("S3_TEST_SECRET_KEY", "minioadmin"),
+	})
+	if err := createBucket(s); err != nil {
+		t.Fatalf("creating bucket: %s", err)
+	}
+	prefix := fmt.Sprintf("test-%d/", time.Now().UnixNano())
+	t.Cleanup(func() {
+		objects, _ := s.List(prefix)
+		for _, obj := range objects {
+			s.Delete(obj.Key)
+		}
+	})
+	testStore(t, s, prefix)
+}
+
+// testStore checks the behaviour every Store has to have, keeping
+// everything it writes under prefix.
+func testStore(t *testing.T, store Store, prefix string) {
+	key := func(k string) string { return prefix + k }
+
+	t.Run("PutGet", func(t *testing.T) {
+		body := []byte("hello, world")
+		n, err := store.Put(key("galleries/1/hello.txt"), bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Put() err = %s", err)
+		}
+		if n != int64(len(body)) {
+			t.Errorf("Put() = %d, want %d", n, len(body))
+		}
+		got := readAll(t, store, key("galleries/1/hello.txt"))
+		if !bytes.Equal(got, body) {
+			t.Errorf("Get() = %q, want %q", got, body)
+		}
+	})
+
+	t.Run("PutReplaces", func(t *testing.T) {
+		k := key("galleries/1/replace.txt")
+		if _, err := store.Put(k, strings.NewReader("first")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Put(k, strings.NewReader("second")); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, store, k); string(got) != "second" {
+			t.Errorf("Get() = %q, want %q", got, "second")
+		}
+	})
+
+	t.Run("EscapedKey", func(t *testing.T) {
+		// spaces and plus signs are where sigv4 escaping goes wrong
+		k := key("galleries/1/my photo+1 (copy).jpg")
+		if _, err := store.Put(k, strings.NewReader("jpeg")); err != nil {
+			t.Fatalf("Put() err = %s", err)
+		}
+		if got := readAll(t, store, k); string(got) != "jpeg" {
+			t.Errorf("Get() = %q, want %q", got, "jpeg")
+		}
+	})
+
+	t.Run("OpenSeek", func(t *testing.T) {
+		body := []byte("0123456789abcdefghij")
+		k := key("galleries/2/seek.txt")
+		if _, err := store.Put(k, bytes.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+		f, obj, err := store.Open(k)
+		if err != nil {
+			t.Fatalf("Open() err = %s", err)
+		}
+		defer f.Close()
+		if obj.Size != int64(len(body)) {
+			t.Errorf("Open() size = %d, want %d", obj.Size, len(body))
+		}
+		if _, err := f.Seek(10, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "abcde" {
+			t.Errorf("read after seek = %q, want %q", buf, "abcde")
+		}
+		if _, err := f.Seek(-3, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rest) != "hij" {
+			t.Errorf("read from end = %q, want %q", rest, "hij")
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		for _, k := range []string{"list/a/1.jpg", "list/a/2.jpg", "list/b/3.jpg"} {
+			if _, err := store.Put(key(k), strings.NewReader(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		objects, err := store.List(key("list/a/"))
+		if err != nil {
+			t.Fatalf("List() err = %s", err)
+		}
+		var keys []string
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+		sort.Strings(keys)
+		want := []string{key("list/a/1.jpg"), key("list/a/2.jpg")}
+		if strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Errorf("List() = %v, want %v", keys, want)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		k := key("galleries/3/delete.txt")
+		if _, err := store.Put(k, strings.NewReader("bye")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(k); err != nil {
+			t.Fatalf("Delete() err = %s", err)
+		}
+		if _, err := store.Get(k); err != ErrNotExist {
+			t.Errorf("Get() after Delete() err = %v, want ErrNotExist", err)
+		}
+		if err := store.Delete(k); err != nil {
+			t.Errorf("Delete() twice err = %s, want nil", err)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		if _, err := store.Get(key("nope/missing.txt")); err != ErrNotExist {
+			t.Errorf("Get() err = %v, want ErrNotExist", err)
+		}
+		if _, _, err := store.Open(key("nope/missing.txt")); err != ErrNotExist {
+			t.Errorf("Open() err = %v, want ErrNotExist", err)
+		}
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		for _, k := range []string{"", "../escape.txt", "a//b.txt", "a\\b.txt"} {
+			if _, err := store.Put(k, strings.NewReader("x")); err != ErrInvalidKey {
+				t.Errorf("Put(%q) err = %v, want ErrInvalidKey", k, err)
+			}
+		}
+	})
+}
+
+func readAll(t *testing.T, store Store, key string) []byte {
+	t.Helper()
+	rc, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) err = %s", key, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// createBucket makes the bucket unless it's there already.
+func createBucket(s *S3) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL("", nil), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		if strings.Contains(err.Error(), "BucketAlreadyOwnedByYou") || strings.Contains(err.Error(), "BucketAlreadyExists") {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}